@@ -0,0 +1,590 @@
+package main
+
+// Downgrade the ANSI (VT100) escape sequences modern hosts send for
+// terminals that don't understand them.  The DTE's terminal is in S202
+// (or the phonebook entry's "Terminal"):
+//
+//   ansi   leave everything alone
+//   strip  remove escape sequences, leaving the text
+//   vt52   translate cursor movement and erasing to VT52 sequences
+//   adm3a  translate cursor movement and clearing to ADM-3A codes
+//   dumb   keep a model of the screen the host thinks it's drawing and
+//          print it as plain lines of text
+//
+// For a VT52 the cursor keys are translated back to ANSI on the way to
+// the host.
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TERM_ANSI = iota
+	TERM_STRIP
+	TERM_VT52
+	TERM_ADM3A
+	TERM_DUMB
+)
+
+var terminalNames = []string{"ansi", "strip", "vt52", "adm3a", "dumb"}
+
+func terminalName(t byte) string {
+	if int(t) < len(terminalNames) {
+		return terminalNames[t]
+	}
+	return "unknown"
+}
+
+func terminalByName(name string) (byte, bool) {
+	name = strings.ToLower(strings.Replace(name, "-", "", -1))
+	for i, n := range terminalNames {
+		if n == name {
+			return byte(i), true
+		}
+	}
+	return TERM_ANSI, false
+}
+
+// Escape sequence parser states
+const (
+	ST_TEXT      = iota
+	ST_ESC       // Saw ESC
+	ST_ESC_INTER // ESC, intermediate bytes
+	ST_CSI       // ESC [
+	ST_STRING    // ESC ] (OSC), ESC P (DCS)... up to BEL or ESC \
+	ST_STRING_ESC
+)
+
+// Give up on sequences longer than this
+const __MAX_ESC_SEQ = 64
+
+// Implements stage for terminal downgrading
+type ansiStage struct {
+	terminal byte
+	state    int
+	seq      []byte
+	screen   *screenModel // TERM_DUMB only
+	keyEsc   bool         // VT52 cursor keys: saw ESC from the DTE
+}
+
+// nil if there's nothing to do
+func newAnsiStage(terminal byte, cols, rows int, utf8 bool) stage {
+	if terminal == TERM_ANSI || int(terminal) >= len(terminalNames) {
+		return nil
+	}
+	logger.Printf("Downgrading ANSI sequences for a %s terminal",
+		terminalName(terminal))
+	a := &ansiStage{terminal: terminal}
+	if terminal == TERM_DUMB {
+		a.screen = newScreenModel(cols, rows, utf8)
+	}
+	return a
+}
+
+func (a *ansiStage) ToDTE(p []byte) []byte {
+	var out []byte
+	for _, c := range p {
+		out = a.feed(out, c)
+	}
+	return out
+}
+
+// VT52 cursor keys send ESC A..D; hosts want ESC [ A..D.
+func (a *ansiStage) FromDTE(p []byte) []byte {
+	if a.terminal != TERM_VT52 {
+		return p
+	}
+
+	var out []byte
+	for _, c := range p {
+		switch {
+		case a.keyEsc && c >= 'A' && c <= 'D':
+			out = append(out, 0x1b, '[', c)
+		case a.keyEsc:
+			out = append(out, 0x1b, c)
+		case c == 0x1b:
+			a.keyEsc = true
+			continue
+		default:
+			out = append(out, c)
+		}
+		a.keyEsc = false
+	}
+	return out
+}
+
+func (a *ansiStage) feed(out []byte, c byte) []byte {
+	switch a.state {
+	case ST_TEXT:
+		if c == 0x1b {
+			a.state = ST_ESC
+			a.seq = append(a.seq[:0], c)
+			return out
+		}
+		if a.screen != nil {
+			return a.screen.text(out, c)
+		}
+		return append(out, c)
+
+	case ST_ESC:
+		a.seq = append(a.seq, c)
+		switch {
+		case c == '[':
+			a.state = ST_CSI
+		case c == ']' || c == 'P' || c == '_' || c == '^':
+			a.state = ST_STRING
+		case c >= 0x20 && c <= 0x2f:
+			a.state = ST_ESC_INTER
+		default:
+			a.state = ST_TEXT
+			return a.escape(out, c)
+		}
+
+	case ST_ESC_INTER:
+		// Character set designation and the like; nothing to translate
+		a.seq = append(a.seq, c)
+		if c >= 0x30 && c <= 0x7e {
+			a.state = ST_TEXT
+		}
+
+	case ST_CSI:
+		a.seq = append(a.seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			a.state = ST_TEXT
+			return a.csi(out, string(a.seq[2:len(a.seq)-1]), c)
+		}
+
+	case ST_STRING:
+		a.seq = append(a.seq, c)
+		switch c {
+		case 0x07:
+			a.state = ST_TEXT
+		case 0x1b:
+			a.state = ST_STRING_ESC
+		}
+
+	case ST_STRING_ESC:
+		a.seq = append(a.seq, c)
+		a.state = ST_STRING
+		if c == '\\' {
+			a.state = ST_TEXT
+		}
+	}
+
+	if len(a.seq) > __MAX_ESC_SEQ {
+		a.state = ST_TEXT
+	}
+	return out
+}
+
+// ESC <c>
+func (a *ansiStage) escape(out []byte, c byte) []byte {
+	switch {
+	case c == 'M' && a.terminal == TERM_VT52: // Reverse index
+		return append(out, 0x1b, 'I')
+	case c == 'M' && a.terminal == TERM_ADM3A:
+		return append(out, 0x0b)
+	}
+	return out
+}
+
+// Parse CSI parameters, "" and missing ones as def.  ok is false for
+// private (DEC) sequences.
+func csiParams(params string, def int) (p []int, ok bool) {
+	if params != "" && strings.ContainsAny(params[:1], "<=>?") {
+		return nil, false
+	}
+	for _, s := range strings.Split(params, ";") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n == 0 {
+			n = def
+		}
+		p = append(p, n)
+	}
+	return p, true
+}
+
+// VT52 and ADM-3A cursor addresses are the 1 based row or column plus 31
+func cursorPos(n int) byte {
+	if n > 95 {
+		n = 95
+	}
+	return byte(31 + n)
+}
+
+// ESC [ <params> <final>
+func (a *ansiStage) csi(out []byte, params string, final byte) []byte {
+	def := 1
+	if final == 'J' || final == 'K' {
+		def = 0
+	}
+	p, ok := csiParams(params, def)
+	if !ok {
+		return out
+	}
+	n := p[0]
+	if n > 255 {
+		n = 255
+	}
+
+	switch a.terminal {
+	case TERM_VT52:
+		switch final {
+		case 'A', 'B', 'C', 'D':
+			for i := 0; i < n; i++ {
+				out = append(out, 0x1b, final)
+			}
+		case 'H', 'f':
+			row, col := n, 1
+			if len(p) > 1 {
+				col = p[1]
+			}
+			if row == 1 && col == 1 {
+				return append(out, 0x1b, 'H')
+			}
+			out = append(out, 0x1b, 'Y', cursorPos(row),
+				cursorPos(col))
+		case 'J':
+			switch n {
+			case 0:
+				out = append(out, 0x1b, 'J')
+			case 2, 3:
+				out = append(out, 0x1b, 'H', 0x1b, 'J')
+			}
+		case 'K':
+			if n == 0 {
+				out = append(out, 0x1b, 'K')
+			}
+		}
+
+	case TERM_ADM3A:
+		codes := map[byte]byte{'A': 0x0b, 'B': 0x0a, 'C': 0x0c, 'D': 0x08}
+		switch final {
+		case 'A', 'B', 'C', 'D':
+			for i := 0; i < n; i++ {
+				out = append(out, codes[final])
+			}
+		case 'H', 'f':
+			row, col := n, 1
+			if len(p) > 1 {
+				col = p[1]
+			}
+			if row == 1 && col == 1 {
+				return append(out, 0x1e)
+			}
+			out = append(out, 0x1b, '=', cursorPos(row),
+				cursorPos(col))
+		case 'J':
+			if n == 2 || n == 3 {
+				out = append(out, 0x1a)
+			}
+		}
+
+	case TERM_DUMB:
+		col := 1
+		if len(p) > 1 {
+			col = p[1]
+		}
+		out = a.screen.csi(out, final, p[0], col)
+	}
+	return out
+}
+
+// A model of the screen the host thinks it's drawing, for dumb
+// terminals.  Text that arrives in order streams straight through.  Once
+// the host starts moving the cursor around, changes go into the model
+// and a row is printed as a whole line when the cursor leaves it.
+type screenModel struct {
+	cols, rows int
+	cells      [][]string // UTF-8 characters
+	dirty      []bool     // Changed since the DTE last saw it
+	row, col   int        // The host's cursor
+	dteRow     int        // The row the DTE's cursor is on, -1 if none
+	dteCol     int
+	utf8       bool
+	partial    []byte // A partial UTF-8 character
+}
+
+func newScreenModel(cols, rows int, utf8 bool) *screenModel {
+	s := &screenModel{cols: cols, rows: rows, utf8: utf8}
+	s.cells = make([][]string, rows)
+	for i := range s.cells {
+		s.cells[i] = make([]string, cols)
+	}
+	s.dirty = make([]bool, rows)
+	return s
+}
+
+func (s *screenModel) inSync() bool {
+	return s.row == s.dteRow && s.col == s.dteCol
+}
+
+func (s *screenModel) text(out []byte, c byte) []byte {
+	switch {
+	case s.utf8 && c >= 0x80:
+		s.partial = append(s.partial, c)
+		if !utf8.FullRune(s.partial) {
+			return out
+		}
+		ch := string(s.partial)
+		s.partial = s.partial[:0]
+		return s.put(out, ch)
+
+	case c >= 0x20 && c != 0x7f:
+		return s.put(out, string(c))
+
+	case c == '\r':
+		s.col = 0
+		if s.dteRow == s.row {
+			s.dteCol = 0
+			out = append(out, c)
+		}
+
+	case c == '\n':
+		out = s.lineFeed(out)
+
+	case c == '\b':
+		if s.col > 0 {
+			if s.inSync() {
+				s.dteCol--
+				out = append(out, c)
+			}
+			s.col--
+		}
+
+	case c == '\t':
+		col := (s.col/8 + 1) * 8
+		if col >= s.cols {
+			col = s.cols - 1
+		}
+		if s.inSync() {
+			s.dteCol = col
+			out = append(out, c)
+		}
+		s.col = col
+
+	case c == 0x07:
+		out = append(out, c)
+	}
+	return out
+}
+
+// Put a character at the cursor, wrapping at the right margin.
+func (s *screenModel) put(out []byte, ch string) []byte {
+	if s.col >= s.cols {
+		s.col = 0
+		if s.dteRow == s.row {
+			out = append(out, '\r')
+			s.dteCol = 0
+		}
+		out = s.lineFeed(out)
+	}
+	if !s.inSync() {
+		out = s.catchUp(out)
+	}
+	s.cells[s.row][s.col] = ch
+	if s.inSync() {
+		out = append(out, ch...)
+		s.dteCol++
+	} else {
+		s.dirty[s.row] = true
+	}
+	s.col++
+	return out
+}
+
+func (s *screenModel) lineFeed(out []byte) []byte {
+	out = s.leaveRow(out)
+	passed := s.dteRow == s.row
+	if passed {
+		out = append(out, '\n')
+	}
+	if s.row == s.rows-1 {
+		s.scroll()
+		if !passed && s.dteRow > 0 {
+			s.dteRow--
+		}
+	} else {
+		s.row++
+	}
+	if passed {
+		s.dteRow = s.row
+	}
+	return out
+}
+
+func (s *screenModel) scroll() {
+	copy(s.cells, s.cells[1:])
+	copy(s.dirty, s.dirty[1:])
+	s.cells[s.rows-1] = make([]string, s.cols)
+	s.dirty[s.rows-1] = false
+}
+
+// If the host's cursor is below or to the right of the DTE's, move the
+// DTE's there so text can stream again.  A dumb terminal can't go back.
+func (s *screenModel) catchUp(out []byte) []byte {
+	switch {
+	case s.dteRow < 0:
+		out = append(out, '\r', '\n')
+		s.dteRow, s.dteCol = s.row, 0
+	case s.row > s.dteRow:
+		for r := s.dteRow + 1; r < s.row; r++ {
+			if s.dirty[r] {
+				out = s.flush(out, r)
+			}
+		}
+		for r := s.dteRow; r < s.row; r++ {
+			out = append(out, '\r', '\n')
+		}
+		s.dteRow, s.dteCol = s.row, 0
+	case s.row < s.dteRow || s.col < s.dteCol:
+		return out
+	}
+
+	for ; s.dteCol < s.col; s.dteCol++ {
+		ch := s.cells[s.row][s.dteCol]
+		if ch == "" {
+			ch = " "
+		}
+		out = append(out, ch...)
+	}
+	return out
+}
+
+// The cursor's leaving this row; print it if the DTE hasn't seen it.
+func (s *screenModel) leaveRow(out []byte) []byte {
+	if s.dirty[s.row] {
+		out = s.flush(out, s.row)
+	}
+	return out
+}
+
+// Print row r as a line, keeping the gap from the last line printed.
+func (s *screenModel) flush(out []byte, r int) []byte {
+	var line string
+	for _, ch := range s.cells[r] {
+		if ch == "" {
+			ch = " "
+		}
+		line += ch
+	}
+	line = strings.TrimRight(line, " ")
+
+	switch {
+	case s.dteRow == r:
+		out = append(out, '\r')
+	case s.dteRow >= 0 && r > s.dteRow:
+		for i := s.dteRow; i < r; i++ {
+			out = append(out, '\r', '\n')
+		}
+	default:
+		out = append(out, '\r', '\n')
+	}
+	out = append(out, line...)
+	s.dteRow = r
+	s.dteCol = utf8.RuneCountInString(line)
+	s.dirty[r] = false
+	return out
+}
+
+func (s *screenModel) moveTo(out []byte, row, col int) []byte {
+	if row < 0 {
+		row = 0
+	}
+	if row >= s.rows {
+		row = s.rows - 1
+	}
+	if col < 0 {
+		col = 0
+	}
+	if col >= s.cols {
+		col = s.cols - 1
+	}
+	if row != s.row {
+		out = s.leaveRow(out)
+	}
+	s.row, s.col = row, col
+	return out
+}
+
+// Clear cells [from, to) of row r.  to can be past the end of the row,
+// as s.col+1 is after a full width line.
+func (s *screenModel) clear(r, from, to int) {
+	if to > s.cols {
+		to = s.cols
+	}
+	for i := from; i < to; i++ {
+		s.cells[r][i] = ""
+	}
+}
+
+func (s *screenModel) csi(out []byte, final byte, n, col int) []byte {
+	switch final {
+	case 'A':
+		out = s.moveTo(out, s.row-n, s.col)
+	case 'B':
+		out = s.moveTo(out, s.row+n, s.col)
+	case 'C':
+		out = s.moveTo(out, s.row, s.col+n)
+	case 'D':
+		out = s.moveTo(out, s.row, s.col-n)
+	case 'H', 'f':
+		out = s.moveTo(out, n-1, col-1)
+	case 'G':
+		out = s.moveTo(out, s.row, n-1)
+	case 'd':
+		out = s.moveTo(out, n-1, s.col)
+
+	case 'J':
+		switch n {
+		case 0:
+			s.clear(s.row, s.col, s.cols)
+			for r := s.row + 1; r < s.rows; r++ {
+				s.clear(r, 0, s.cols)
+			}
+		case 1:
+			for r := 0; r < s.row; r++ {
+				s.clear(r, 0, s.cols)
+			}
+			s.clear(s.row, 0, s.col+1)
+		case 2, 3:
+			// Print what the host drew before it goes
+			for r := 0; r < s.rows; r++ {
+				if s.dirty[r] {
+					out = s.flush(out, r)
+				}
+				s.clear(r, 0, s.cols)
+			}
+			s.dteRow = -1
+		}
+
+	case 'K':
+		switch n {
+		case 0:
+			s.clear(s.row, s.col, s.cols)
+		case 1:
+			s.clear(s.row, 0, s.col+1)
+		case 2:
+			s.clear(s.row, 0, s.cols)
+		}
+	}
+	return out
+}
+
+// AT*term[=name]
+func setTerminal(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		t, ok := terminalByName(cmd[i+1:])
+		if !ok {
+			return ERROR
+		}
+		registers.Set(REG_TERMINAL, int(t))
+	}
+
+	serial.Printf("TERMINAL: %s\n",
+		strings.ToUpper(terminalName(registers.Read(REG_TERMINAL))))
+	return OK
+}
@@ -0,0 +1,317 @@
+package main
+
+// Local HTTP/JSON management API.  Off unless -api is given, and every
+// request must carry "Authorization: Bearer <-apitoken>".
+//
+//   GET    /api/state            modem state (what AT* shows)
+//   GET    /api/phonebook        phonebook entries, by position (without
+//                                 passwords)
+//   POST   /api/phonebook        add {"Position": n, "Entry": {...}} at an
+//                                 empty position; not exec entries, which
+//                                 run programs
+//   GET    /api/phonebook/<n>    one phonebook entry
+//   DELETE /api/phonebook/<n>    delete a phonebook entry
+//   GET    /api/registers        all S-registers
+//   GET    /api/registers/<n>    one S-register
+//   PUT    /api/registers/<n>    write an S-register {"Value": v}
+//   POST   /api/hangup           hang up (ATH0)
+//   POST   /api/dial             dial {"Number": "T5551212"} (ATD...), if
+//                                 the DTE isn't in a call or a command
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type apiPhonebookEntry struct {
+	Position int     `json:"Position"`
+	Entry    pb_host `json:"Entry"`
+}
+
+type apiRegister struct {
+	Register int `json:"Register"`
+	Value    int `json:"Value"`
+}
+
+type apiDialRequest struct {
+	Number string `json:"Number"` // Everything after ATD
+}
+
+// A dial for handleSerial(), which owns the DTE and the modem's state, to
+// run.  It says on accepted whether it will.
+type apiDialJob struct {
+	cmd      string
+	accepted chan error
+}
+
+var apiDials = make(chan apiDialJob)
+
+type apiResult struct {
+	Result string `json:"Result"`
+}
+
+type apiError struct {
+	Error string `json:"Error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		logger.Printf("API: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	logger.Printf("API error: %s", err)
+	writeJSON(w, code, apiError{err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// Require the bearer token on every request.
+func apiAuth(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			logger.Printf("API: unauthorized request from %s",
+				r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized,
+				apiError{"unauthorized"})
+			return
+		}
+		logger.Printf("API: %s %s from %s", r.Method, r.URL.Path,
+			r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parse the <n> off the end of /api/<thing>/<n>.  ok is false if there
+// isn't one.
+func apiIndex(path, prefix string) (n int, ok bool, err error) {
+	s := strings.TrimPrefix(path, prefix)
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return 0, false, nil
+	}
+	n, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, true, fmt.Errorf("Bad index '%s'", s)
+	}
+	return n, true, nil
+}
+
+// Shown in place of a phonebook entry's password
+const __API_REDACTED = "********"
+
+// The phonebook as the API shows it: passwords stay in the phonebook
+func apiEntries() map[int]pb_host {
+	e := phonebook.Entries()
+	for i, h := range e {
+		if h.Password != "" {
+			h.Password = __API_REDACTED
+			e[i] = h
+		}
+	}
+	return e
+}
+
+func apiState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, currentState())
+}
+
+func apiPhonebook(w http.ResponseWriter, r *http.Request) {
+	pos, indexed, err := apiIndex(r.URL.Path, "/api/phonebook")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && !indexed:
+		writeJSON(w, http.StatusOK, apiEntries())
+
+	case r.Method == http.MethodGet:
+		h, ok := apiEntries()[pos]
+		if !ok {
+			writeError(w, http.StatusNotFound,
+				fmt.Errorf("No entry at position %d", pos))
+			return
+		}
+		writeJSON(w, http.StatusOK, apiPhonebookEntry{pos, h})
+
+	case r.Method == http.MethodPost && !indexed:
+		var e apiPhonebookEntry
+		if err := readJSON(r, &e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if strings.ToUpper(e.Entry.Protocol) == "EXEC" {
+			writeError(w, http.StatusForbidden, fmt.Errorf(
+				"exec entries can only be added to the phonebook file"))
+			return
+		}
+		if err := phonebook.AddEntry(e.Position, e.Entry); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if e.Entry.Password != "" {
+			e.Entry.Password = __API_REDACTED
+		}
+		writeJSON(w, http.StatusCreated, e)
+
+	case r.Method == http.MethodDelete && indexed:
+		if _, ok := phonebook.Entries()[pos]; !ok {
+			writeError(w, http.StatusNotFound,
+				fmt.Errorf("No entry at position %d", pos))
+			return
+		}
+		if err := phonebook.Delete(pos); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+	}
+}
+
+func apiRegisters(w http.ResponseWriter, r *http.Request) {
+	reg, indexed, err := apiIndex(r.URL.Path, "/api/registers")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if indexed && (reg < 0 || reg >= __NUM_REGS) {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("No register %d", reg))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && !indexed:
+		writeJSON(w, http.StatusOK, registers.JsonMap())
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK,
+			apiRegister{reg, int(registers.Read(reg))})
+
+	case r.Method == http.MethodPut && indexed:
+		var v apiRegister
+		if err := readJSON(r, &v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// Go through the same checks as ATSn=v
+		status := registerCmd(fmt.Sprintf("S%d=%d", reg, v.Value))
+		if status != OK {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("Can't set S%d to %d: %s", reg, v.Value,
+					resultName(status)))
+			return
+		}
+		writeJSON(w, http.StatusOK,
+			apiRegister{reg, int(registers.Read(reg))})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+	}
+}
+
+func apiHangup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	status := hangup()
+	if status != OK { // There was a call, tell the DTE it's gone
+		prstatus(status)
+	}
+	writeJSON(w, http.StatusOK, apiResult{resultName(status)})
+}
+
+// Dial on behalf of the DTE.  handleSerial() makes the call, so the DTE
+// sees the result code as though it had typed the ATD itself.
+func apiDial(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	var d apiDialRequest
+	if err := readJSON(r, &d); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cmd := "ATD" + d.Number
+	if c, err := parseCommand(cmd); err != nil || len(c) != 1 {
+		writeError(w, http.StatusBadRequest,
+			fmt.Errorf("Bad dial string '%s'", d.Number))
+		return
+	}
+
+	// handleSerial() only takes it when it's waiting for the DTE
+	job := apiDialJob{cmd, make(chan error, 1)}
+	select {
+	case apiDials <- job:
+	default:
+		writeError(w, http.StatusConflict,
+			fmt.Errorf("Modem busy running a command"))
+		return
+	}
+	if err := <-job.accepted; err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, apiDialRequest{d.Number})
+}
+
+// Serve the management API on addr.
+// Must be a goroutine
+func serveAPI(addr string, token string) {
+	if token == "" {
+		logger.Print("Management API not started: no -apitoken given")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/state", apiState)
+	mux.HandleFunc("/api/phonebook", apiPhonebook)
+	mux.HandleFunc("/api/phonebook/", apiPhonebook)
+	mux.HandleFunc("/api/registers", apiRegisters)
+	mux.HandleFunc("/api/registers/", apiRegisters)
+	mux.HandleFunc("/api/hangup", apiHangup)
+	mux.HandleFunc("/api/dial", apiDial)
+
+	logger.Printf("Listening: management API http/%s", addr)
+	if err := http.ListenAndServe(addr, apiAuth(token, mux)); err != nil {
+		logger.Printf("Management API failed: %s", err)
+	}
+}
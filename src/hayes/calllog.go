@@ -0,0 +1,227 @@
+package main
+
+// Call detail records.  Every call, answered or not, is appended to the
+// call log as one line of JSON.  When the log grows past its size limit
+// it's rotated to <file>.1, <file>.2, ...
+
+import (
+	"bufio"
+	"code.cloudfoundry.org/bytefmt"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many rotated call logs to keep
+const __CALL_LOG_KEEP = 3
+
+// How many calls AT*calls shows
+const __RECENT_CALLS = 10
+
+type callRecord struct {
+	Direction    string    `json:"Direction"` // "inbound" or "outbound"
+	Number       string    `json:"Number"`    // What the DTE dialed
+	Name         string    `json:"Name"`      // Phonebook name, if any
+	Host         string    `json:"Host"`
+	Protocol     string    `json:"Protocol"`
+	Start        time.Time `json:"Start"`
+	End          time.Time `json:"End"`
+	Duration     float64   `json:"Duration"` // Seconds
+	BytesIn      uint64    `json:"BytesIn"`  // From the remote
+	BytesOut     uint64    `json:"BytesOut"` // To the remote
+	Result       string    `json:"Result"`
+	HangupReason string    `json:"HangupReason"`
+}
+
+func newCallRecord(direction int) *callRecord {
+	var r callRecord
+	switch direction {
+	case INBOUND:
+		r.Direction = "inbound"
+	case OUTBOUND:
+		r.Direction = "outbound"
+	}
+	r.Start = time.Now()
+	return &r
+}
+
+// Fill in where the call went from a phonebook entry
+func (r *callRecord) setEntry(entry pb_host) {
+	r.Name = entry.Name
+	r.Host = entry.Host
+	r.Protocol = strings.ToLower(entry.Protocol)
+}
+
+// Close out the record with the final result code and why the call ended.
+func (r *callRecord) finish(result error, reason string) {
+	r.End = time.Now()
+	r.Duration = r.End.Sub(r.Start).Seconds()
+	r.Result = resultName(result)
+	r.HangupReason = reason
+}
+
+func (r callRecord) String() string {
+	dir := "IN "
+	if r.Direction == "outbound" {
+		dir = "OUT"
+	}
+	who := r.Number
+	if r.Name != "" {
+		who = r.Name
+	}
+	if who == "" {
+		who = r.Host
+	}
+	d := time.Duration(r.Duration) * time.Second
+	return fmt.Sprintf("%s %s %-16s %-6s %8s %-10s tx %s rx %s (%s)",
+		r.Start.Format("01/02 15:04:05"), dir, who, r.Protocol, d,
+		r.Result, bytefmt.ByteSize(r.BytesOut),
+		bytefmt.ByteSize(r.BytesIn), r.HangupReason)
+}
+
+type callLog struct {
+	filename string
+	maxSize  int64
+	lock     sync.Mutex
+	log      *log.Logger
+}
+
+func newCallLog(filename string, maxSize int64, log *log.Logger) *callLog {
+	return &callLog{filename: filename, maxSize: maxSize, log: log}
+}
+
+// Append a record to the call log, rotating first if it's full.
+func (c *callLog) Add(r *callRecord) error {
+	if c.filename == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		c.log.Print(err)
+		return err
+	}
+	b = append(b, '\n')
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if fi, err := os.Stat(c.filename); err == nil &&
+		fi.Size() > 0 && fi.Size()+int64(len(b)) > c.maxSize {
+		c.rotate()
+	}
+
+	f, err := os.OpenFile(c.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+	if err != nil {
+		c.log.Printf("Can't open call log: %s", err)
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(b); err != nil {
+		c.log.Printf("Can't write call log: %s", err)
+	}
+	return err
+}
+
+// <file>.2 -> <file>.3, <file>.1 -> <file>.2, <file> -> <file>.1
+// Must be called with c.lock held.
+func (c *callLog) rotate() {
+	c.log.Printf("Rotating call log %s", c.filename)
+	for i := __CALL_LOG_KEEP - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", c.filename, i)
+		to := fmt.Sprintf("%s.%d", c.filename, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			c.log.Print(err)
+		}
+	}
+	if err := os.Rename(c.filename, c.filename+".1"); err != nil {
+		c.log.Print(err)
+	}
+}
+
+// The last n calls, oldest first.
+func (c *callLog) Recent(n int) ([]callRecord, error) {
+	var records []callRecord
+
+	if c.filename == "" {
+		return nil, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The current log may not hold n calls right after a rotation,
+	// so read the previous one too.
+	for _, name := range []string{c.filename + ".1", c.filename} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r callRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				c.log.Printf("Bad call log entry in %s: %s",
+					name, err)
+				continue
+			}
+			records = append(records, r)
+		}
+		f.Close()
+	}
+
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records, nil
+}
+
+// The text of a result code, regardless of ATV and ATQ.
+func resultName(e error) string {
+	if e == nil {
+		return "OK"
+	}
+	if me, ok := e.(*MError); ok {
+		return strings.TrimSpace(me.text)
+	}
+	return e.Error()
+}
+
+// Write the active call's record to the call log.
+func logCall(result error, reason string) {
+	r := m.takeCall()
+	if r == nil {
+		return
+	}
+	r.finish(result, reason)
+	logger.Printf("Call: %s", r)
+	countCall(r)
+	calls.Add(r)
+}
+
+// AT*calls
+func showCalls() error {
+	records, err := calls.Recent(__RECENT_CALLS)
+	if err != nil {
+		logger.Print(err)
+		return ERROR
+	}
+
+	serial.Println("RECENT CALLS:")
+	if len(records) == 0 {
+		serial.Println("  NONE")
+	}
+	for _, r := range records {
+		serial.Printf("  %s\n", r)
+	}
+	return OK
+}
@@ -0,0 +1,53 @@
+package main
+
+// Losing the carrier.  When a call's network connection fails, the modem
+// drops DCD and waits S10 tenths of a second for the carrier to come back
+// before hanging up, like a real modem riding out a noisy line.  Outbound
+// telnet and SSH calls to phonebook entries with "Reconnect": true are
+// redialed in that time; the host sees a new session, so it's off by
+// default.
+
+import (
+	"time"
+)
+
+// Implemented by connections that can be redialed after a network
+// failure.
+type reconnector interface {
+	Reconnect(timeout time.Duration) error
+}
+
+// How long between reconnection attempts
+const __RECONNECT_WAIT = 250 * time.Millisecond
+
+// The connection failed with err.  Wait up to S10 for the carrier to come
+// back, reconnecting if we can; returns true if it did.
+func waitForCarrier(err error) bool {
+	grace := time.Duration(registers.Read(
+		REG_DELAY_BETWEEN_LOST_CARRIER_AND_HANGUP)) * 100 * time.Millisecond
+	logger.Printf("Lost carrier (%s), waiting %s", err, grace)
+
+	m.setCarrierLost(true)
+	defer m.setCarrierLost(false)
+
+	r, ok := m.getConn().(reconnector)
+	if m.entry == nil || !m.entry.Reconnect {
+		ok = false
+	}
+
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) && m.offHook() {
+		if !ok {
+			time.Sleep(__RECONNECT_WAIT)
+			continue
+		}
+		if err := r.Reconnect(time.Until(deadline)); err != nil {
+			logger.Print("Reconnect failed: ", err)
+			time.Sleep(__RECONNECT_WAIT)
+			continue
+		}
+		logger.Print("Carrier restored")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,495 @@
+package main
+
+// Character set translation.  The DTE's character set is in S200 and
+// the remote host's in S201 (or the phonebook entry's "DTECharset" and
+// "Charset").  Text is decoded to Unicode on the way in and encoded in the
+// other side's character set on the way out.  Characters the other side
+// doesn't have are approximated: box drawing becomes the nearest
+// graphics character, or +, - and | on plain ASCII.
+//
+// PETSCII is the Commodore lower/upper case set, so letters swap case,
+// and ATASCII is the Atari set.  Both get their own end of line and
+// delete characters, and their cursor keys are sent to the host as ANSI
+// cursor sequences.
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	CHARSET_NONE = iota // No translation
+	CHARSET_ASCII
+	CHARSET_UTF8
+	CHARSET_CP437
+	CHARSET_PETSCII
+	CHARSET_ATASCII
+)
+
+var charsetNames = []string{"none", "ascii", "utf8", "cp437", "petscii",
+	"atascii"}
+
+func charsetName(cs byte) string {
+	if int(cs) < len(charsetNames) {
+		return charsetNames[cs]
+	}
+	return "unknown"
+}
+
+func charsetByName(name string) (byte, bool) {
+	name = strings.ToLower(strings.Replace(name, "-", "", -1))
+	for i, n := range charsetNames {
+		if n == name {
+			return byte(i), true
+		}
+	}
+	return CHARSET_NONE, false
+}
+
+// Converts between a character set and Unicode.  Codecs may keep state
+// (partial UTF-8 sequences, a CR waiting for its LF), so each direction
+// of a call gets its own.
+type codec interface {
+	decode(p []byte) []rune
+	encode(r []rune) []byte
+}
+
+func newCodec(cs byte) codec {
+	switch cs {
+	case CHARSET_ASCII:
+		return &asciiCodec{}
+	case CHARSET_CP437:
+		return &cp437Codec{}
+	case CHARSET_PETSCII:
+		return &petsciiCodec{}
+	case CHARSET_ATASCII:
+		return &atasciiCodec{}
+	}
+	return &utf8Codec{}
+}
+
+// Implements stage for character set translation
+type charsetStage struct {
+	hostDecoder codec // Remote -> DTE
+	dteEncoder  codec
+	dteDecoder  codec // DTE -> remote
+	hostEncoder codec
+}
+
+// nil if there's nothing to translate
+func newCharsetStage(dte, host byte) stage {
+	if host == CHARSET_NONE {
+		host = CHARSET_UTF8
+	}
+	if dte == CHARSET_NONE || dte == host || int(dte) >= len(charsetNames) {
+		return nil
+	}
+	logger.Printf("Translating %s (host) <-> %s (DTE)", charsetName(host),
+		charsetName(dte))
+	return &charsetStage{newCodec(host), newCodec(dte), newCodec(dte),
+		newCodec(host)}
+}
+
+func (c *charsetStage) ToDTE(p []byte) []byte {
+	return c.dteEncoder.encode(c.hostDecoder.decode(p))
+}
+
+func (c *charsetStage) FromDTE(p []byte) []byte {
+	return c.hostEncoder.encode(c.dteDecoder.decode(p))
+}
+
+// Something like r for character sets that don't have it.
+func approximate(r rune) string {
+	if a, ok := asciiApprox[r]; ok {
+		return a
+	}
+	switch {
+	case r >= 0x2500 && r <= 0x257f: // Box drawing
+		return "+"
+	case r >= 0x2580 && r <= 0x259f: // Blocks
+		return "#"
+	}
+	return "?"
+}
+
+var asciiApprox = map[rune]string{
+	'─': "-", '━': "-", '═': "-", '│': "|", '┃': "|", '║': "|",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-",
+	'…': "...", '•': "*", '·': ".", '∙': ".", '\u00a0': " ", '©': "(c)",
+	'®': "(r)", '±': "+/-", '÷': "/", '×': "x", '«': "<<", '»': ">>",
+	'£': "L", '¢': "c", '¥': "Y", '↑': "^", '←': "<", '→': ">", '↓': "v",
+	'♦': "*", '♠': "*", '■': "#", 'ß': "ss",
+}
+
+// Double and mixed box drawing characters as their single line
+// equivalents, for character sets with only single lines.
+var singleBox = map[rune]rune{
+	'═': '─', '║': '│', '╔': '┌', '╗': '┐', '╚': '└', '╝': '┘',
+	'╠': '├', '╣': '┤', '╦': '┬', '╩': '┴', '╬': '┼',
+	'╒': '┌', '╓': '┌', '╕': '┐', '╖': '┐', '╘': '└', '╙': '└',
+	'╛': '┘', '╜': '┘', '╞': '├', '╟': '├', '╡': '┤', '╢': '┤',
+	'╤': '┬', '╥': '┬', '╧': '┴', '╨': '┴', '╪': '┼', '╫': '┼',
+	'━': '─', '┃': '│',
+}
+
+// Machines with their own end of line character want one per line,
+// whether the host ends lines with CR, LF or CRLF.  Returns true if r
+// should be sent as eol; a LF right after a CR is dropped.
+type eolState struct {
+	sawCR bool
+}
+
+func (e *eolState) isEOL(r rune) (eol bool, drop bool) {
+	prevCR := e.sawCR
+	e.sawCR = r == '\r'
+	switch r {
+	case '\r':
+		return true, false
+	case '\n':
+		return !prevCR, prevCR
+	}
+	return false, false
+}
+
+// UTF-8
+type utf8Codec struct {
+	pending []byte // A partial sequence
+	latin1  bool   // Bytes that aren't UTF-8 are Latin-1, not U+FFFD
+}
+
+func (u *utf8Codec) decode(p []byte) []rune {
+	var r []rune
+	b := append(u.pending, p...)
+	for len(b) > 0 {
+		if !utf8.FullRune(b) {
+			break
+		}
+		c, n := utf8.DecodeRune(b)
+		if c == utf8.RuneError && n == 1 && u.latin1 {
+			c = rune(b[0])
+		}
+		r = append(r, c)
+		b = b[n:]
+	}
+	u.pending = append([]byte{}, b...)
+	return r
+}
+
+// The partial sequence left at the end, one byte at a time
+func (u *utf8Codec) flush() []rune {
+	var r []rune
+	for _, c := range u.pending {
+		if u.latin1 {
+			r = append(r, rune(c))
+		} else {
+			r = append(r, utf8.RuneError)
+		}
+	}
+	u.pending = nil
+	return r
+}
+
+func (u *utf8Codec) encode(r []rune) []byte {
+	return []byte(string(r))
+}
+
+// 7 bit ASCII
+type asciiCodec struct{}
+
+func (a *asciiCodec) decode(p []byte) []rune {
+	r := make([]rune, 0, len(p))
+	for _, c := range p {
+		if c < 0x80 {
+			r = append(r, rune(c))
+		} else {
+			r = append(r, '?')
+		}
+	}
+	return r
+}
+
+func (a *asciiCodec) encode(r []rune) []byte {
+	b := make([]byte, 0, len(r))
+	for _, c := range r {
+		if c < 0x80 {
+			b = append(b, byte(c))
+		} else {
+			b = append(b, approximate(c)...)
+		}
+	}
+	return b
+}
+
+// IBM PC code page 437.  The bottom half is ASCII; 0x00-0x1F are left as
+// control characters rather than the smiley faces and card suits.
+var cp437 = [128]rune{
+	'Ç', 'ü', 'é', 'â', 'ä', 'à', 'å', 'ç', 'ê', 'ë', 'è', 'ï', 'î', 'ì', 'Ä', 'Å',
+	'É', 'æ', 'Æ', 'ô', 'ö', 'ò', 'û', 'ù', 'ÿ', 'Ö', 'Ü', '¢', '£', '¥', '₧', 'ƒ',
+	'á', 'í', 'ó', 'ú', 'ñ', 'Ñ', 'ª', 'º', '¿', '⌐', '¬', '½', '¼', '¡', '«', '»',
+	'░', '▒', '▓', '│', '┤', '╡', '╢', '╖', '╕', '╣', '║', '╗', '╝', '╜', '╛', '┐',
+	'└', '┴', '┬', '├', '─', '┼', '╞', '╟', '╚', '╔', '╩', '╦', '╠', '═', '╬', '╧',
+	'╨', '╤', '╥', '╙', '╘', '╒', '╓', '╫', '╪', '┘', '┌', '█', '▄', '▌', '▐', '▀',
+	'α', 'ß', 'Γ', 'π', 'Σ', 'σ', 'µ', 'τ', 'Φ', 'Θ', 'Ω', 'δ', '∞', 'φ', 'ε', '∩',
+	'≡', '±', '≥', '≤', '⌠', '⌡', '÷', '≈', '°', '∙', '·', '√', 'ⁿ', '²', '■', '\u00a0',
+}
+
+var cp437Reverse = func() map[rune]byte {
+	m := make(map[rune]byte)
+	for i, u := range cp437 {
+		m[u] = byte(i + 0x80)
+	}
+	return m
+}()
+
+type cp437Codec struct{}
+
+func (c *cp437Codec) decode(p []byte) []rune {
+	r := make([]rune, 0, len(p))
+	for _, b := range p {
+		if b < 0x80 {
+			r = append(r, rune(b))
+		} else {
+			r = append(r, cp437[b-0x80])
+		}
+	}
+	return r
+}
+
+func (c *cp437Codec) encode(r []rune) []byte {
+	b := make([]byte, 0, len(r))
+	for _, u := range r {
+		if u < 0x80 {
+			b = append(b, byte(u))
+		} else if x, ok := cp437Reverse[u]; ok {
+			b = append(b, x)
+		} else {
+			b = append(b, approximate(u)...)
+		}
+	}
+	return b
+}
+
+// Commodore PETSCII, lower/upper case character set
+var petsciiGraphics = map[byte]rune{
+	0x5c: '£', 0x5e: '↑', 0x5f: '←', 0x60: '─', 0x7b: '┼', 0x7d: '│',
+	0xa0: '\u00a0', 0xa1: '▌', 0xa2: '▄', 0xa4: '_', 0xa6: '▒',
+	0xab: '├', 0xad: '└', 0xae: '┐', 0xb0: '┌', 0xb1: '┴', 0xb2: '┬',
+	0xb3: '┤', 0xbd: '┘', 0xc0: '─', 0xdb: '┼', 0xdd: '│',
+}
+
+var petsciiFromUnicode = map[rune][]byte{
+	'£': {0x5c}, '↑': {0x5e}, '^': {0x5e}, '←': {0x5f}, '_': {0xa4},
+	'|': {0xdd}, '\\': {'/'}, '{': {'('}, '}': {')'}, '~': {'-'},
+	'`': {'\''}, '\u00a0': {0xa0}, '▌': {0xa1}, '▄': {0xa2},
+	'░': {0xa6}, '▒': {0xa6}, '▓': {0xa6}, '─': {0xc0}, '│': {0xdd},
+	'┌': {0xb0}, '┐': {0xae}, '└': {0xad}, '┘': {0xbd}, '├': {0xab},
+	'┤': {0xb3}, '┬': {0xb2}, '┴': {0xb1}, '┼': {0xdb},
+	'█': {0x12, ' ', 0x92}, // Reverse video space
+}
+
+type petsciiCodec struct {
+	eol eolState
+}
+
+func (c *petsciiCodec) decode(p []byte) []rune {
+	var r []rune
+	for _, b := range p {
+		switch {
+		case b == 0x0d:
+			r = append(r, '\r')
+		case b == 0x14: // DEL key
+			r = append(r, '\b')
+		case b == 0x93: // CLR
+			r = append(r, '\f')
+		case b == 0x07:
+			r = append(r, '\a')
+		case b == 0x91: // Cursor keys
+			r = append(r, []rune("\x1b[A")...)
+		case b == 0x11:
+			r = append(r, []rune("\x1b[B")...)
+		case b == 0x1d:
+			r = append(r, []rune("\x1b[C")...)
+		case b == 0x9d:
+			r = append(r, []rune("\x1b[D")...)
+		case b >= 0x41 && b <= 0x5a:
+			r = append(r, rune(b-0x41+'a'))
+		case b >= 0x61 && b <= 0x7a:
+			r = append(r, rune(b-0x61+'A'))
+		case b >= 0xc1 && b <= 0xda:
+			r = append(r, rune(b-0xc1+'A'))
+		case petsciiGraphics[b] != 0:
+			r = append(r, petsciiGraphics[b])
+		case b >= 0x20 && b <= 0x5d:
+			r = append(r, rune(b))
+		case b < 0x20 || (b >= 0x80 && b < 0xa0):
+			// Colours and other screen controls
+		default:
+			r = append(r, '?')
+		}
+	}
+	return r
+}
+
+func (c *petsciiCodec) encode(r []rune) []byte {
+	var b []byte
+	for _, u := range r {
+		if eol, drop := c.eol.isEOL(u); eol || drop {
+			if eol {
+				b = append(b, 0x0d)
+			}
+			continue
+		}
+		if s, ok := singleBox[u]; ok {
+			u = s
+		}
+
+		switch {
+		case u == '\b' || u == 0x7f:
+			b = append(b, 0x14)
+		case u == '\f':
+			b = append(b, 0x93)
+		case u == '\a':
+			b = append(b, 0x07)
+		case u == '\t':
+			b = append(b, ' ')
+		case u < 0x20:
+			// No equivalent
+		case u >= 'a' && u <= 'z':
+			b = append(b, byte(u-'a'+0x41))
+		case u >= 'A' && u <= 'Z':
+			b = append(b, byte(u-'A'+0xc1))
+		case petsciiFromUnicode[u] != nil:
+			b = append(b, petsciiFromUnicode[u]...)
+		case u < 0x80:
+			b = append(b, byte(u))
+		default:
+			b = append(b, c.encode([]rune(approximate(u)))...)
+		}
+	}
+	return b
+}
+
+// Atari ATASCII
+var atasciiGraphics = map[byte]rune{
+	0x01: '├', 0x03: '┘', 0x04: '┤', 0x05: '┐', 0x11: '┌', 0x12: '─',
+	0x13: '┼', 0x17: '┬', 0x18: '┴', 0x1a: '└', 0x60: '♦', 0x7b: '♠',
+}
+
+var atasciiFromUnicode = map[rune][]byte{
+	'├': {0x01}, '┘': {0x03}, '┤': {0x04}, '┐': {0x05}, '┌': {0x11},
+	'─': {0x12}, '┼': {0x13}, '┬': {0x17}, '┴': {0x18}, '└': {0x1a},
+	'│': {'|'}, '♦': {0x60}, '♠': {0x7b}, '█': {0xa0}, '`': {'\''},
+	'{': {'('}, '}': {')'}, '~': {'-'},
+}
+
+type atasciiCodec struct {
+	eol eolState
+}
+
+func (c *atasciiCodec) decode(p []byte) []rune {
+	var r []rune
+	for _, b := range p {
+		switch b {
+		case 0x9b: // EOL
+			r = append(r, '\r')
+			continue
+		case 0x7e:
+			r = append(r, '\b')
+			continue
+		case 0x7f:
+			r = append(r, '\t')
+			continue
+		case 0x7d:
+			r = append(r, '\f')
+			continue
+		case 0xfd:
+			r = append(r, '\a')
+			continue
+		case 0x1b:
+			r = append(r, 0x1b)
+			continue
+		case 0x1c: // Cursor keys
+			r = append(r, []rune("\x1b[A")...)
+			continue
+		case 0x1d:
+			r = append(r, []rune("\x1b[B")...)
+			continue
+		case 0x1e:
+			r = append(r, []rune("\x1b[D")...)
+			continue
+		case 0x1f:
+			r = append(r, []rune("\x1b[C")...)
+			continue
+		}
+
+		b &= 0x7f // Inverse video
+		switch {
+		case atasciiGraphics[b] != 0:
+			r = append(r, atasciiGraphics[b])
+		case b >= 0x20 && b < 0x7d:
+			r = append(r, rune(b))
+		default:
+			r = append(r, '?')
+		}
+	}
+	return r
+}
+
+func (c *atasciiCodec) encode(r []rune) []byte {
+	var b []byte
+	for _, u := range r {
+		if eol, drop := c.eol.isEOL(u); eol || drop {
+			if eol {
+				b = append(b, 0x9b)
+			}
+			continue
+		}
+		if s, ok := singleBox[u]; ok {
+			u = s
+		}
+
+		switch {
+		case u == '\b' || u == 0x7f:
+			b = append(b, 0x7e)
+		case u == '\t':
+			b = append(b, 0x7f)
+		case u == '\f':
+			b = append(b, 0x7d)
+		case u == '\a':
+			b = append(b, 0xfd)
+		case atasciiFromUnicode[u] != nil:
+			b = append(b, atasciiFromUnicode[u]...)
+		case u < 0x20:
+			// No equivalent
+		case u < 0x7d:
+			b = append(b, byte(u))
+		default:
+			b = append(b, c.encode([]rune(approximate(u)))...)
+		}
+	}
+	return b
+}
+
+// AT*charset[=dte[,host]]
+func setCharset(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		names := strings.Split(cmd[i+1:], ",")
+		if len(names) > 2 {
+			return ERROR
+		}
+		regs := []int{REG_DTE_CHARSET, REG_HOST_CHARSET}
+		for n, name := range names {
+			cs, ok := charsetByName(name)
+			if !ok {
+				return ERROR
+			}
+			registers.Set(regs[n], int(cs))
+		}
+	}
+
+	serial.Printf("CHARSET: DTE %s, HOST %s\n",
+		strings.ToUpper(charsetName(registers.Read(REG_DTE_CHARSET))),
+		strings.ToUpper(charsetName(registers.Read(REG_HOST_CHARSET))))
+	return OK
+}
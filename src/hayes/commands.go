@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,12 +16,17 @@ func answer() error {
 
 	pickup()
 
-	// Simulate Carrier Detect delay;
-	// REG_CARRIER_DETECT_RESPONSE_TIME is in 1/10's of a second (100ms)
-	cd := registers.Read(REG_CARRIER_DETECT_RESPONSE_TIME)
-	for cd > 0 && !m.getdcd() {
+	// If there's a call ringing, wait up to S7 for the carrier.  If
+	// there isn't one yet, give it S9 more to turn up
+	// (REG_CARRIER_DETECT_RESPONSE_TIME is in 1/10's of a second).
+	ringing := !m.getLastRingTime().IsZero()
+	deadline := time.Now().Add(connectTimeout())
+	for ringing && !m.getdcd() && time.Now().Before(deadline) {
 		time.Sleep(100 * time.Millisecond)
-		cd--
+	}
+	if !m.getdcd() {
+		cd := registers.Read(REG_CARRIER_DETECT_RESPONSE_TIME)
+		time.Sleep(time.Duration(cd) * 100 * time.Millisecond)
 	}
 
 	if !m.getdcd() {
@@ -34,6 +41,12 @@ func answer() error {
 }
 
 
+// ATZ=name
+func softResetNamed(name string) error {
+	logger.Printf("Switching config/registers")
+	return profiles.SwitchNamed(name)
+}
+
 // ATZn - 0 == config 0, 1 == config 1
 func softReset(i int) error {
 	logger.Printf("Switching config/registers")
@@ -58,7 +71,7 @@ func factoryReset() error {
 
 	registers.Reset()
 	conf.Reset()
-	profiles, _ = newStoredProfiles()
+	profiles, _ = newStoredProfiles(flags.profiles)
 	profiles.Switch(profiles.PowerUpConfig)
 
 	phonebook = NewPhonebook(flags.phoneBook, logger)
@@ -67,8 +80,10 @@ func factoryReset() error {
 		logger.Print(err)
 	}
 
-	stopGuardCodeTimer()
-	startGuardCodeTimer()
+	dialplan = NewDialplan(flags.dialPlan, logger)
+	if e := dialplan.Load(); e != nil {
+		logger.Print(e)
+	}
 
 	raiseCTS()
 	raiseDSR()
@@ -83,7 +98,7 @@ func amperV() error {
 	serial.Println()
 	serial.Println(profiles)
 	serial.Println("TELEPHONE NUMBERS:")
-	serial.Println(phonebook)
+	serial.Print(profiles.numbersString())
 	return OK
 }
 
@@ -103,50 +118,14 @@ func registerCmd(cmd string) error {
 	// Sn=x - write x to n
 	_, err = fmt.Sscanf(cmd, "S%d=%d", &reg, &val)
 	if err == nil {
-		if reg > __NUM_REGS || reg < 0 {
-			return fmt.Errorf("Register index over/underflow: %d", reg)
-		}
-		if val > 255 || val < 0 {
-			return fmt.Errorf("Register value over/underflow: %d", val)
-		}
-		
-		// Validate input and update modem state
-		switch reg {
-		case REG_AUTO_ANSWER:
-			if val == 0 {
-				led_AA_off()
-			} else {
-				led_AA_on()
-			}
-		case REG_ESC_CODE_GUARD_TIME:
-			resetGuardCodeTimer(val)
-		case REG_ESC_CH:
-			escSequence[0] = byte(val)
-			escSequence[1] = byte(val)
-			escSequence[2] = byte(val)
-		case REG_BLIND_DIAL_WAIT:
-			if val < 2 {
-				return ERROR
-			}
-		case REG_COMMA_DELAY:
-			if val > 65 {
-				return ERROR
-			}
-		case REG_BS_CH, REG_LF_CH, REG_CR_CH:
-			if val > 127 {
-				return ERROR
-			}
-		}
-
-		registers.Write(reg, byte(val))
-		return OK
+		return registers.Set(reg, val)
 	}
 
 	// Sn? - query register n
 	_, err = fmt.Sscanf(cmd, "S%d?", &reg)
 	if err == nil {
-		if reg > __NUM_REGS || reg < 0 {
-			return fmt.Errorf("Register index over/underflow: %d", reg)
+		if registerDef(reg) == nil {
+			return fmt.Errorf("Unknown register: %d", reg)
 		}
 		logger.Printf("Reading register %d", reg)
 		serial.Printf("%d\n", registers.Read(reg))
@@ -156,10 +135,9 @@ func registerCmd(cmd string) error {
 	// Sn - slect register
 	_, err = fmt.Sscanf(cmd, "S%d", &reg)
 	if err == nil {
-		if reg > __NUM_REGS || reg < 0 {
-			return fmt.Errorf("Register index over/underflow: %d", reg)
+		if err = registers.SetCurrent(reg); err != nil {
+			return err
 		}
-		registers.SetCurrent(reg)
 		return OK
 	}
 
@@ -197,6 +175,10 @@ func processAmpersand(cmd string) error {
 			return factoryReset()
 		}
 
+	case 'Q': // Error control, for /ARQ and progress messages
+		conf.errorControl = int(cmd[1] - '0')
+		return nil
+
 	case 'S':
 		conf.dsrPinned = cmd[1] == '0'
 		return nil
@@ -211,6 +193,8 @@ func processAmpersand(cmd string) error {
 
 	case 'W':
 		switch cmd[1] {
+		case '=':
+			return profiles.writeNamed(cmd[2:])
 		case '0':
 			return profiles.writeActive(0)
 		case '1':
@@ -226,19 +210,23 @@ func processAmpersand(cmd string) error {
 		}
 
 	case 'Z':
-		var s string
 		var i int
-		if _, err := fmt.Sscanf(cmd, "Z%d=%s", &i, &s); err != nil {
+		e := strings.IndexByte(cmd, '=')
+		if _, err := fmt.Sscanf(cmd[:e], "Z%d", &i); err != nil {
 			logger.Printf("%s", err)
 			return fmt.Errorf("Malformed AT& command: %s", cmd)
 		}
-		if s[0] == 'D' || s[0] == 'd' { // Extension
+		s := cmd[e+1:]
+		switch {
+		case s == "D" || s == "d": // Extension, delete a host entry
 			return phonebook.Delete(i)
+		case strings.Contains(s, "|"): // Extension, add a host entry
+			return phonebook.Add(i, s)
 		}
-		return phonebook.Add(i, s)
+		return profiles.storeNumber(i, s)
 
 	// Faked out AT& commands
-	case 'A','B','G','J','K','L','M','O','Q','R','T','U','X':
+	case 'A','B','G','J','K','L','M','O','R','T','U','X':
 		return nil
 
 	default:
@@ -252,12 +240,20 @@ func processAmpersand(cmd string) error {
 func processSingleCommand(cmd string) error {
 	var status error
 
+	if pers.faked(cmd) == len(cmd) {
+		return OK
+	}
+
 	switch cmd[0] {
 	case 'A':
 		status = answer()
 
 	case 'Z':
 		var c int
+		if cmd[1] == '=' {
+			status = softResetNamed(cmd[2:])
+			break
+		}
 		switch cmd[1] {
 		case '0':
 			c = 0
@@ -267,7 +263,7 @@ func processSingleCommand(cmd string) error {
 		status = softReset(c)
 
 	case 'E':
-		conf.echoInCmdMode = cmd[1] == '0'
+		conf.echoInCmdMode = cmd[1] == '1'
 
 	case 'H':
 		switch cmd[1] {
@@ -278,41 +274,14 @@ func processSingleCommand(cmd string) error {
 		}
 
 	case 'I':
-		switch cmd[1] {
-		case '0':
-			serial.Println("14400")
-		case '1':
-			serial.Println("058") // From my Hayes Ultra 96
-		case '2':
-			prstatus(OK)
-			serial.Println()
-		case '3':
-			serial.Println("04-0045012 240 PASS")
-			serial.Println()
-			serial.Println("04-00471-3143 080 PASS")
-			serial.Println()
-			serial.Println("04-00472-3143 190 PASS")
-			serial.Println()
-		case '4':
-			serial.Println("a097841F284C6403F00000090")
-			serial.Println()
-			serial.Println("bF60437000")
-			serial.Println()
-			serial.Println("r1031111111010000")
-			serial.Println()
-			serial.Println("r3000111010000000")
-			serial.Println()
-		case '5':
-			serial.Println("004")
-			serial.Println("a 001 001 003 PASS")
-		}
-		status = OK
+		n, _ := strconv.Atoi(cmd[1:])
+		status = identify(n)
 
 	case 'Q':
-		conf.quiet = cmd[1] == '0'
+		conf.quiet = cmd[1] == '1'
 
 	case 'V':
-		conf.verbose = cmd[1] == '0'
+		conf.verbose = cmd[1] == '1'
 
 	case 'L':
 		switch cmd[1] {
@@ -347,25 +316,11 @@ func processSingleCommand(cmd string) error {
 			status = ERROR
 		}
 
-	case 'W':
-		switch cmd[1] {
-		case '0': conf.connectMsgSpeed = false
-		case '1', '2': conf.connectMsgSpeed = true
-		default: status = ERROR
-		}
+	case 'W': // Negotiation progress messages
+		conf.negotiation = int(cmd[1] - '0')
 
 	case 'X': // Change result codes displayed
-		switch cmd[1] {
-		case '0':
-			conf.extendedResultCodes = false
-			conf.busyDetect = false
-		case '1', '2':
-			conf.extendedResultCodes = true
-			conf.busyDetect = false
-		case '3', '4', '5', '6', '7':
-			conf.extendedResultCodes = true
-			conf.busyDetect = true
-		}
+		conf.resultLevel = int(cmd[1] - '0')
 
 	case 'D':
 		status = dial(cmd)
@@ -379,6 +334,9 @@ func processSingleCommand(cmd string) error {
 	case '*':
 		status = debug(cmd)
 
+	case '+':
+		status = extendedCommand(cmd)
+
 	case 'B', 'C', 'F', 'N', 'P', 'T', 'Y': // faked out commands
 		status = OK
 
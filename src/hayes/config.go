@@ -1,9 +1,5 @@
 package main
 
-import (
-	"fmt"
-)
-
 // Configuration
 type Config struct {
 	echoInCmdMode       bool
@@ -11,9 +7,9 @@ type Config struct {
 	speakerVolume       int
 	verbose             bool
 	quiet               bool
-	connectMsgSpeed     bool
-	busyDetect          bool
-	extendedResultCodes bool
+	resultLevel         int // ATX
+	negotiation         int // ATW
+	errorControl        int // AT&Q
 	dcdPinned           bool
 	dsrPinned           bool
 	dtr                 int
@@ -25,57 +21,33 @@ func (c *Config) Reset() {
 	c.verbose = true       // Text return codes
 	c.speakerVolume = 2    // moderate volume
 	c.speakerMode = 1      // on until other modem heard
-	c.busyDetect = true    // BUSY or OK result code?
-	c.extendedResultCodes = true
+	c.resultLevel = 4      // All result codes
+	c.negotiation = 0      // No progress messages
+	c.errorControl = 0     // No /ARQ
 	c.dcdPinned = true	// if true, DCD if fixed 'on'
-	c.connectMsgSpeed = true
 	c.dsrPinned = true	// if true, DSR is fixed 'on'
 	c.dtr = 0
 }
 
-func (c *Config) String() string {
-	b := func(p bool) string {
-		if p {
-			return "1 "
-		}
-		return "0 "
-	}
-	i := func(p int) string {
-		return fmt.Sprintf("%d ", p)
-	}
-	x := func(r, b bool) string {
-		if r == true && b == false {
-			return "1 "
-		}
-		if r == true && b == true {
-			return "7 "
-		}
-		return "0 "
-	}
+// The settings, in stored profile form
+func (c *Config) stored() configtype {
+	var s configtype
 
-	str := "B16 B1 B41 B60 "
-	str += "E" + b(c.echoInCmdMode)
-	str += "F1 " // For Hayes 1200 compatability
-	str += "L" + i(c.speakerVolume)
-	str += "M" + i(c.speakerMode)
-	str += "N1 "
-	str += "Q" + b(c.quiet)
-	str += "V" + b(c.verbose)
-	str += "W" + b(c.connectMsgSpeed)
-	str += "X" + x(c.extendedResultCodes, c.busyDetect)
-	str += "Y0 "
-	str += "&A0 "
-	str += "&C" + b(c.dcdPinned)
-	str += "&D" + i(c.dtr)
-	str += "&G0 "
-	str += "&J0 "
-	str += "&K0 "
-	str += "&Q5 "
-	str += "&R0 "
-	str += "&S" + b(c.dsrPinned)
-	str += "&T4 "
-	str += "&U0 "
-	str += "&X4 "
+	s.EchoInCmdMode = c.echoInCmdMode
+	s.SpeakerVolume = c.speakerVolume
+	s.SpeakerMode = c.speakerMode
+	s.Quiet = c.quiet
+	s.Verbose = c.verbose
+	s.ResultLevel = c.resultLevel
+	s.Negotiation = c.negotiation
+	s.ErrorControl = c.errorControl
+	s.DCDPinned = c.dcdPinned
+	s.DSRPinned = c.dsrPinned
+	s.DTR = c.dtr
+	return s
+}
 
-	return lineWrap(str, 80)
+// As the personality lays it out
+func (c *Config) String() string {
+	return pers.profileLine(c.stored())
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"code.cloudfoundry.org/bytefmt"
+	"fmt"
+	"io"
 	"net"
 	"time"
 )
@@ -29,6 +31,36 @@ type connection interface {
 	SetDeadline(t time.Time) error
 }
 
+// A net.Addr for connections that don't go over the network
+type pseudoAddr struct {
+	network string
+	addr    string
+}
+
+func (a pseudoAddr) Network() string { return a.network }
+func (a pseudoAddr) String() string  { return a.addr }
+
+// A net.Error timeout, for connections that don't go over the network
+// (so serviceConnection() can apply S30) and for dialing.
+type timeoutError string
+
+func (e timeoutError) Error() string { return string(e) }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Describe the active connection for the user, preferring the
+// phonebook name of the entry dialed over the remote host.
+func describeConnection() string {
+	conn := m.getConn()
+	if conn == nil {
+		return ""
+	}
+	if m.entry != nil && m.entry.Name != "" {
+		return ">" + m.entry.Name
+	}
+	return conn.String()
+}
+
 func startAcceptingCalls() {
 	started_ok := make(chan error)
 
@@ -59,12 +91,13 @@ func startAcceptingCalls() {
 
 
 // Pass bytes from the remote dialer to the serial port as long as we're offhook, we're
-// in DATA MODE and we have valid carrier
-func serviceConnection() {
+// in DATA MODE and we have valid carrier.  Returns why the call ended.
+func serviceConnection() string {
 	var t time.Time
 	var timeout time.Duration
 
-	logger.Printf("Servicing connection with remote %s", m.conn.RemoteAddr())
+	conn := m.getConn()
+	logger.Printf("Servicing connection with remote %s", conn.RemoteAddr())
 
 	buf := make([]byte, 1)
 	for {
@@ -76,17 +109,18 @@ func serviceConnection() {
 		} else {
 			t = time.Now().Add(timeout)
 		}
-		if err := m.conn.SetDeadline(t); err != nil {
+		if err := conn.SetDeadline(t); err != nil {
 			logger.Printf("conn.SetDeadline(): %s", err)
-			return
+			return fmt.Sprintf("error: %s", err)
 		}
 		
-		if _, err := m.conn.Read(buf); err != nil { // Remote hung up or ...
+		if _, err := conn.Read(buf); err != nil { // Remote hung up or ...
 			nerr, ok := err.(net.Error)	    // we timed out.
 			switch {
 			case ok && nerr.Timeout():
 				logger.Printf("conn.Read(): triggered S30 timeout: %s",
 					timeout)
+				return "inactivity timeout"
 			case ok && nerr.Temporary():
 				logger.Printf("conn.Read(): temporary errory: %s",
 				err)
@@ -94,28 +128,51 @@ func serviceConnection() {
 			default: 
 				logger.Print("conn.Read(): ", err)
 			}
-			return
+			if m.onHook() { // We closed the connection
+				return "local hangup"
+			}
+			if err == io.EOF {
+				return "remote hangup"
+			}
+			if waitForCarrier(err) {
+				continue
+			}
+			return fmt.Sprintf("remote hangup: %s", err)
 		}
 
 		if m.getdcd() == false {
 			logger.Print("conn.Read(): No carrier at network read")
-			return
+			return "local hangup"
 		}
 
 		if m.onHook() {
 			logger.Print("conn.Read(): On hook at network read")
-			return
+			return "local hangup"
 		}
 
 		// Send the byte to the DTE, blink the RD LED
 		if m.getMode() == DATAMODE {
 			led_RD_on()
-			serial.Write(buf)
+			if out := translateToDTE(buf); len(out) > 0 {
+				serial.Write(out)
+			}
+			recordOutput(buf)
 			led_RD_off()
 		}
 	}
 }
 
+// Which protocol did an incoming call arrive on?
+func inboundProtocol(conn connection) string {
+	switch conn.(type) {
+	case *telnetReadWriteCloser:
+		return "telnet"
+	case *sshAcceptReadWriteCloser:
+		return "ssh"
+	}
+	return ""
+}
+
 // Accept connection's from dial*() and accept*() functions.
 func handleCalls() {
 	startAcceptingCalls()
@@ -137,8 +194,14 @@ func handleCalls() {
 		switch conn.Direction() {
 		case INBOUND:
 			logger.Printf("Incomming call from %s", conn.RemoteAddr())
+			m.newCall(INBOUND)
+			m.updateCall(func(r *callRecord) {
+				r.Host = conn.RemoteAddr().String()
+				r.Protocol = inboundProtocol(conn)
+			})
 			if !answerIncomming(conn) {
 				conn.Close()
+				logCall(NO_ANSWER, "not answered")
 				continue
 			}
 		case OUTBOUND:
@@ -147,7 +210,8 @@ func handleCalls() {
 
 		// We now have an established connection (either answered or dialed)
 		// so service it.
-		m.conn = conn
+		m.setConn(conn)
+		meterCall(conn)
 		m.setMode(conn.Mode())
 		m.setConnectSpeed(38400)
 		m.dcdHigh()	// Force DCD "up" here.
@@ -155,15 +219,27 @@ func handleCalls() {
 			prstatus(CONNECT)
 		}
 		time.Sleep(250 * time.Millisecond)
-		serviceConnection()
+		if recordingWanted() {
+			startRecording()
+		}
+		startTranslation()
+		reason := serviceConnection()
+		stopTranslation()
+		stopRecording()
 
 		if m.getdcd() == true { // User didn't hang up, so print status
 			serial.Printf("\n")
 			prstatus(NO_CARRIER)
 		}
-		sent, recv := m.conn.Stats()
+		sent, recv := conn.Stats()
+		m.updateCall(func(r *callRecord) {
+			r.BytesOut = sent
+			r.BytesIn = recv
+		})
+		logCall(CONNECT, reason)
+		meterCall(nil) // If there was no call record to count
 		conn.Close()
-		m.conn = nil
+		m.setConn(nil)
 		hangup()
 		logger.Printf("Connection closed, sent %s recv %s",
 			bytefmt.ByteSize(sent), bytefmt.ByteSize(recv))
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,52 +22,97 @@ func pf(format string, a ...interface{}) {
 
 type out func(string, ...interface{})
 
-// Debug function
-func outputState(debugf out) {
+// A snapshot of the modem's state, shown by AT* and the management API
+type modemState struct {
+	CurrentConfig   int        `json:"CurrentConfig"`
+	Mode            string     `json:"Mode"`
+	LastCmd         string     `json:"LastCmd"`
+	LastDialed      string     `json:"LastDialed"`
+	ConnectSpeed    int        `json:"ConnectSpeed"`
+	DCD             bool       `json:"DCD"`
+	LineBusy        bool       `json:"LineBusy"`
+	OnHook          bool       `json:"OnHook"`
+	Config          configtype `json:"Config"`
+	CurrentRegister int        `json:"CurrentRegister"`
+	Connection      string     `json:"Connection"` // Empty if not connected
+	RemoteAddr      string     `json:"RemoteAddr"`
+	Sent            uint64     `json:"Sent"`
+	Received        uint64     `json:"Received"`
+	Pins            string     `json:"Pins"`
+	GoRoutines      int        `json:"GoRoutines"`
+}
 
-	debugf("Modem state:\n")
-	debugf(" currentconfig: %d\n", m.currentConfig)
+func currentState() modemState {
+	var s modemState
+
+	s.CurrentConfig = m.currentConfig
 	switch m.getMode() {
 	case COMMANDMODE:
-		debugf(" mode         : COMMAND\n")
+		s.Mode = "COMMAND"
 	case DATAMODE:
-		debugf(" mode         : DATA\n")
+		s.Mode = "DATA"
 	}
-	debugf(" lastCmd      : %s\n", m.lastCmd)
-	debugf(" lastDialed   : %s\n", m.lastDialed)
-	debugf(" connectSpeed : %d\n", m.getConnectSpeed())
-	debugf(" dcd          : %t\n", m.getdcd())
-	debugf(" lineBusy     : %t\n", m.getLineBusy())
-	debugf(" onHook       : %t\n", m.onHook())
+	s.LastCmd = m.lastCmd
+	s.LastDialed = m.lastDialed
+	s.ConnectSpeed = m.getConnectSpeed()
+	s.DCD = m.getdcd()
+	s.LineBusy = m.getLineBusy()
+	s.OnHook = m.onHook()
+	s.Config = activeConfig()
+	s.CurrentRegister = registers.ShowCurrent()
+	if conn := m.getConn(); conn != nil {
+		s.Connection = describeConnection()
+		s.RemoteAddr = conn.RemoteAddr().String()
+		s.Sent, s.Received = conn.Stats()
+	}
+	s.Pins = showPins()
+	s.GoRoutines = runtime.NumGoroutine()
+	return s
+}
+
+// Debug function
+func outputState(debugf out) {
+	s := currentState()
+
+	debugf("Modem state:\n")
+	debugf(" currentconfig: %d\n", s.CurrentConfig)
+	debugf(" mode         : %s\n", s.Mode)
+	debugf(" lastCmd      : %s\n", s.LastCmd)
+	debugf(" lastDialed   : %s\n", s.LastDialed)
+	debugf(" connectSpeed : %d\n", s.ConnectSpeed)
+	debugf(" dcd          : %t\n", s.DCD)
+	debugf(" lineBusy     : %t\n", s.LineBusy)
+	debugf(" onHook       : %t\n", s.OnHook)
 
 	debugf("Config:\n")
-	debugf(" echoInCmdMode : %t\n", conf.echoInCmdMode)
-	debugf(" speakerMode   : %d\n", conf.speakerMode)
-	debugf(" speakerVolume : %d\n", conf.speakerVolume)
-	debugf(" verbose       : %t\n", conf.verbose)
-	debugf(" quiet         : %t\n", conf.quiet)
-	debugf(" connctMsgSpeed: %t\n", conf.connectMsgSpeed)
-	debugf(" busyDetect    : %t\n", conf.busyDetect)
-	debugf(" extResultCodes: %t\n", conf.extendedResultCodes)
-	debugf(" dcdPinned     : %t\n", conf.dcdPinned)
-	debugf(" dsrPinned     : %t\n", conf.dsrPinned)
-	debugf(" dtr           : %d\n", conf.dtr)
-
-	debugf("Curent register: %d\n", registers.ShowCurrent())
+	debugf(" echoInCmdMode : %t\n", s.Config.EchoInCmdMode)
+	debugf(" speakerMode   : %d\n", s.Config.SpeakerMode)
+	debugf(" speakerVolume : %d\n", s.Config.SpeakerVolume)
+	debugf(" verbose       : %t\n", s.Config.Verbose)
+	debugf(" quiet         : %t\n", s.Config.Quiet)
+	debugf(" resultLevel   : %d\n", s.Config.ResultLevel)
+	debugf(" negotiation   : %d\n", s.Config.Negotiation)
+	debugf(" errorControl  : %d\n", s.Config.ErrorControl)
+	debugf(" dcdPinned     : %t\n", s.Config.DCDPinned)
+	debugf(" dsrPinned     : %t\n", s.Config.DSRPinned)
+	debugf(" dtr           : %d\n", s.Config.DTR)
+
+	debugf("Curent register: %d\n", s.CurrentRegister)
 	debugf("Registers: %s\n", registers.String())
 
 	debugf("Phonebook: %s\n", phonebook.String())
+	debugf("Dial plan: %s\n", dialplan.String())
 
-	if m.conn != nil {
-		sent, recv := m.conn.Stats()
-		debugf("Connection: %s, tx: %s rx: %s\n", m.conn.RemoteAddr(),
-			bytefmt.ByteSize(sent), bytefmt.ByteSize(recv))
+	if s.Connection != "" {
+		debugf("Connection: %s (%s), tx: %s rx: %s\n", s.Connection,
+			s.RemoteAddr, bytefmt.ByteSize(s.Sent),
+			bytefmt.ByteSize(s.Received))
 	} else {
 		debugf("Connection: <Not connected>\n")
 	}
 	
-	debugf("%s\n", showPins())
-	debugf("GoRoutines: %d\n", runtime.NumGoroutine())
+	debugf("%s\n", s.Pins)
+	debugf("GoRoutines: %d\n", s.GoRoutines)
 }
 
 func showState() {
@@ -100,8 +146,8 @@ func networkStatus() {
 	}
 
 	serial.Println("ACTIVE CONNECTION:")
-	if m.conn != nil {
-		serial.Printf("  %s\n", m.conn)
+	if m.getConn() != nil {
+		serial.Printf("  %s\n", describeConnection())
 	} else {
 		serial.Println("  NONE")
 	}
@@ -124,25 +170,81 @@ func help() {
 	serial.Println("Debug commands:")
 	serial.Println("AT*        - show internal state")
 	serial.Println("AT*network - show network status")
+	serial.Println("AT*dialplan- show dial plan rules")
+	serial.Println("AT*phonebook - show the address book")
+	serial.Println("AT*calls   - show recent calls")
+	serial.Println("AT*record  - toggle call recording")
+	serial.Println("AT*charset[=dte[,host]] - show/set character sets")
+	serial.Println("AT*term[=type] - show/set terminal type")
+	serial.Println("AT*size[=COLSxROWS] - show/set screen size")
+	serial.Println("AT*eol[=dte[,host]] - show/set data mode line ends")
+	serial.Println("AT*pad[=n] - show/set NULs sent after CR")
+	serial.Println("AT*echo[=0|1] - show/set data mode local echo")
+	serial.Println("AT*esc[=hayes|ties] - show/set escape mode")
+	serial.Println("AT*personality[=name] - list/choose modem personality")
+	serial.Println("AT*hist[=n] - show command history/recall command n")
 	serial.Println("AT*ledtest - run the LED test")
 	serial.Println("AT*help    - this help")
+	serial.Println("AT*help=S[n] - describe S-registers")
 	serial.Println("AT*232     - toggle RS232 lines")
 }
 
+// AT*help=S[n]
+func helpRegisters(n string) error {
+	if n == "" {
+		registerHelp(-1)
+		return OK
+	}
+	reg, err := strconv.Atoi(n)
+	if err != nil || registerDef(reg) == nil {
+		return ERROR
+	}
+	registerHelp(reg)
+	return OK
+}
+
 // Given a parsed register command, execute it.
 func debug(cmd string) error {
 	logger.Printf("cmd = '%s'", cmd)
 
-	switch {
+	switch cmd = strings.ToLower(cmd); {
 	case cmd == "*":
 		showState()
 		logState()
 	case cmd == "*help":
 		help()
+	case strings.HasPrefix(cmd, "*help=s"):
+		return helpRegisters(cmd[len("*help=s"):])
 	case cmd == "*ledtest":
 		ledTest(5)
 	case cmd == "*network":
 		networkStatus()
+	case cmd == "*dialplan":
+		serial.Print(dialplan)
+	case cmd == "*phonebook":
+		serial.Print(phonebook)
+	case cmd == "*calls":
+		return showCalls()
+	case cmd == "*record":
+		return toggleRecording()
+	case strings.HasPrefix(cmd, "*charset"):
+		return setCharset(cmd)
+	case strings.HasPrefix(cmd, "*term"):
+		return setTerminal(cmd)
+	case strings.HasPrefix(cmd, "*size"):
+		return setTerminalSize(cmd)
+	case strings.HasPrefix(cmd, "*eol"):
+		return setLineEnds(cmd)
+	case strings.HasPrefix(cmd, "*pad"):
+		return setPadding(cmd)
+	case strings.HasPrefix(cmd, "*echo"):
+		return setLocalEcho(cmd)
+	case strings.HasPrefix(cmd, "*hist"):
+		return showHistory(cmd)
+	case strings.HasPrefix(cmd, "*esc"):
+		return setEscapeMode(cmd)
+	case strings.HasPrefix(cmd, "*personality"):
+		return choosePersonality(cmd)
 	case cmd == "*232":
 		toggleRS232()
 	default:
@@ -16,22 +16,29 @@ type interruptable struct {
 
 func supportedProtocol(proto string) bool {
 	switch strings.ToUpper(proto) {
-	case "TELNET", "SSH":
+	case "TELNET", "SSH", "REPLAY", "EXEC", "SERIAL":
 		return true
 	default:
 		return false
 	}
 }
 
-func makeCall(c chan interruptable, protocol, host, username, password string) {
+func makeCall(c chan interruptable, entry pb_host) {
 	var conn connection
 	var err error
 	
-	switch strings.ToUpper(protocol) {
+	switch strings.ToUpper(entry.Protocol) {
 	case "SSH":
-		conn, err = dialSSH(host, logger, username, password)
+		conn, err = dialSSH(entry.Host, logger, entry.Username,
+			entry.Password)
 	case "TELNET":
-		conn, err = dialTelnet(host, logger)
+		conn, err = dialTelnet(entry.Host, logger)
+	case "REPLAY":
+		conn, err = dialReplay(entry, logger)
+	case "EXEC":
+		conn, err = dialExec(entry, logger)
+	case "SERIAL":
+		conn, err = dialSerial(entry, logger)
 	default: 
 		conn = nil
 		err = fmt.Errorf("Unknown protocol")
@@ -42,50 +49,214 @@ func makeCall(c chan interruptable, protocol, host, username, password string) {
 	c <- interruptable{conn, err}
 }	
 
-// Using the phonebook mapping, fake out dialing a standard phone number
-// (ATDT5551212)
-func dialNumber(phone string) (connection, error) {
+// Call the host in a phonebook entry, after dialing dialString.  Returns
+// nil, nil if the DTE aborts the call.
+func dialEntry(entry pb_host, dialString string) (connection, error) {
 	var i interruptable
 
-	host, protocol, username, password, err := phonebook.Lookup(phone)
-	if err != nil {
-		logger.Print(err)
-		return nil, err
-	}
-
-	logger.Printf("Dialing address book entry: %+v", host)
+	logger.Printf("Dialing address book entry: %s (%s)",
+		entry.displayName(), entry.Host)
 
-	if !supportedProtocol(protocol) {
-		return nil, fmt.Errorf("Unsupported protocol '%s'", protocol)
+	if !supportedProtocol(entry.Protocol) {
+		return nil, fmt.Errorf("Unsupported protocol '%s'",
+			entry.Protocol)
 	}
+	m.entry = &entry
+	m.updateCall(func(r *callRecord) { r.setEntry(entry) })
 
-	simulateDTMF(phone)
+	if !playDialString(dialString) {
+		return nil, nil
+	}
 	RingTone.BackgroundPlay()
 	
 	c := make(chan interruptable)
-	go makeCall(c, protocol, host, username, password)
+	go makeCall(c, entry)
 	select {
 	case i = <- c:
-		logger.Printf("dialNumber(): conn = %v, err = %s", i.conn, i.err)
+		logger.Printf("dialEntry(): conn = %v, err = %s", i.conn, i.err)
 		RingTone.Stop()
 		carrierTone(time.Second * 2)
 		return i.conn, i.err
 	case <-serial.channel:
-		logger.Print("dialNumber(): user abort")
+		logger.Print("dialEntry(): user abort")
 		RingTone.Stop()
+		go abandonCall(c)
 		return nil, nil
+	case <-time.After(connectTimeout()):
+		logger.Print("dialEntry(): no answer")
+		RingTone.Stop()
+		go abandonCall(c)
+		return nil, timeoutError("no answer")
 	}
 }
 
-func dialStoredNumber(idxstr string) (connection, error) {
+// Hang up a call we stopped waiting for, if it ever connects
+func abandonCall(c chan interruptable) {
+	if i := <-c; i.conn != nil {
+		logger.Printf("Closing abandoned call to %s", i.conn.RemoteAddr())
+		i.conn.Close()
+	}
+}
+
+// How long to wait for the remote to answer (S7)
+func connectTimeout() time.Duration {
+	return time.Duration(registers.Read(REG_WAIT_FOR_CARRIER_AFTER_DIAL)) *
+		time.Second
+}
+
+// How long the dial modifiers take
+const (
+	__PULSE_TIME   = 100 * time.Millisecond // Per pulse, at 10 pulses/s
+	__PULSE_GAP    = 700 * time.Millisecond // Between digits
+	__FLASH_TIME   = 500 * time.Millisecond // '!'
+	__QUIET_ANSWER = 5 * time.Second        // '@', silence after a ring
+)
+
+// Wait d, or until the DTE sends something.  Returns false if it did.
+func dialPause(d time.Duration) bool {
+	select {
+	case <-serial.channel:
+		logger.Print("Dialing aborted by DTE")
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func playTone(t *tone, d time.Duration) bool {
+	t.BackgroundPlay()
+	defer t.Stop()
+	return dialPause(d)
+}
+
+// Dial s, taking as long as a real modem would and playing the sounds
+// it would make: the dial tone for S6 seconds, touch tones for S11 ms
+// each (or silent pulses), a pause of S8 seconds for each ',', another
+// dial tone for 'W', a ring and then silence for '@' and a hook flash for
+// '!'.  'T' and 'P' switch between tone and pulse.  Returns false if the
+// DTE aborts.
+func playDialString(s string) bool {
+	blind := time.Duration(registers.Read(REG_BLIND_DIAL_WAIT)) * time.Second
+	comma := time.Duration(registers.Read(REG_COMMA_DELAY)) * time.Second
+	dtmf := time.Duration(registers.Read(REG_MULTIFREQ_TONE_DURATION)) *
+		time.Millisecond
+	pulse := false
+
+	if !playTone(DialTone, blind) {
+		return false
+	}
+
+	for _, key := range strings.ToUpper(s) {
+		ok := true
+		switch {
+		case key == 'T':
+			pulse = false
+		case key == 'P':
+			pulse = true
+		case key == ',':
+			ok = dialPause(comma)
+		case key == 'W':
+			logger.Print("Waiting for dial tone")
+			ok = playTone(DialTone, blind)
+		case key == '@':
+			logger.Print("Waiting for quiet answer")
+			ok = playTone(RingTone, 2*time.Second) &&
+				dialPause(__QUIET_ANSWER)
+		case key == '!':
+			logger.Print("Hook flash")
+			led_OH_off()
+			ok = dialPause(__FLASH_TIME)
+			led_OH_on()
+		case pulse && key >= '0' && key <= '9':
+			n := int(key - '0')
+			if n == 0 {
+				n = 10
+			}
+			ok = dialPause(time.Duration(n)*__PULSE_TIME + __PULSE_GAP)
+		case strings.ContainsRune("0123456789*#ABCD", key):
+			ok = playTone(getKeyTones(key), dtmf) && dialPause(dtmf)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// The number in a dial string, without its modifiers
+func dialedNumber(s string) string {
+	r := strings.NewReplacer(
+		",", "",
+		"@", "",
+		"W", "",
+		"w", "",
+		" ", "",
+		"!", "",
+		";", "",
+		"T", "",
+		"t", "",
+		"P", "",
+		"p", "")
+	return r.Replace(s)
+}
 
-	index, err := strconv.Atoi(idxstr)
+// Using the dial plan and phonebook mapping, fake out dialing a standard
+// phone number (ATDT5551212)
+func dialNumber(dialString string) (connection, error) {
+	phone := dialedNumber(dialString)
+	m.updateCall(func(r *callRecord) { r.Number = phone })
+	entry, err := dialplan.Resolve(phone)
 	if err != nil {
 		logger.Print(err)
 		return nil, err
 	}
+	return dialEntry(entry, dialString)
+}
+
+// Dial a phonebook entry by its name or one of its aliases (ATDN
+// retrobbs, ATD"RETROBBS").  If the name matches more than one entry,
+// tell the user which ones and fail.
+func dialName(name string) (connection, error) {
+	entries := phonebook.LookupName(name)
+	switch len(entries) {
+	case 0:
+		err := fmt.Errorf("Name '%s' not in phone book", name)
+		logger.Print(err)
+		return nil, err
+	case 1:
+		phone, err := sanitizeNumber(entries[0].Phone)
+		if err != nil {
+			phone = ""
+		}
+		return dialEntry(entries[0], phone)
+	}
+
+	logger.Printf("Name '%s' is ambiguous, %d matches", name, len(entries))
+	serial.Printf("\nAMBIGUOUS NAME '%s':\n", name)
+	for _, e := range entries {
+		serial.Printf("  %s (%s)\n", e.displayName(), e.Phone)
+	}
+	return nil, ERROR
+}
+
+// ATDSn or ATDS=n (ATDS is ATDS0): dial AT&Z stored number n, or if
+// there isn't one, the address book entry at position n.
+func dialStoredNumber(idxstr string) (connection, error) {
+	var err error
 
-	phone, err := phonebook.LookupStoredNumber(index)
+	index := 0
+	if idxstr = strings.TrimPrefix(idxstr, "="); idxstr != "" {
+		index, err = strconv.Atoi(idxstr)
+		if err != nil {
+			logger.Print(err)
+			return nil, ERROR
+		}
+	}
+
+	phone := profiles.storedNumber(index)
+	if phone == "" {
+		phone, err = phonebook.LookupStoredNumber(index)
+	}
 	if err != nil {
 		logger.Print("Error: ", err)
 		return nil, ERROR // We want ATDS to return ERROR.
@@ -103,7 +274,8 @@ func splitATDE(cmd string) (string, string, string, error) {
 	return s[0], s[1], s[2], nil
 }
 
-// ATD command (ATD, ATDT, ATDP, ATDL and the extensions ATDH (host) and ATDE (SSH)
+// ATD command (ATD, ATDT, ATDP, ATDL and the extensions ATDH (host), ATDE (SSH)
+// and ATDN (phonebook name)
 // See http://www.messagestick.net/modem/Hayes_Ch1-1.html on ATD... result codes
 func dial(to string) error {
 	var conn connection
@@ -120,31 +292,34 @@ func dial(to string) error {
 	// Now we know the dial command isn't Dial Last (ATDL), save
 	// this number as last dialed
 	m.lastDialed = to
-
-	// Strip out dial modifiers we don't need.
-	r := strings.NewReplacer(
-		",", "",
-		"@", "",
-		"W", "",
-		" ", "",
-		"!", "",
-		";", "")
+	m.newCall(OUTBOUND)
 
 	// Is this ATD<number>?  If so, dial it
 	if unicode.IsDigit(rune(cmd)) {
 		clean_to = to[1:]
-		lcd.Printf(1, "Dialing %s" , clean_to)
-		simulateDTMF(clean_to)
-		clean_to = r.Replace(clean_to)
+		lcd.Printf(1, "Dialing %s" , dialedNumber(clean_to))
 		conn, err = dialNumber(clean_to)
+	} else if cmd == 'N' { // Phonebook name (ATDN retrobbs, ATD"RETROBBS")
+		// Names aren't phone numbers, so leave the dial modifiers in
+		clean_to = strings.TrimSpace(strings.TrimSuffix(to[2:], ";"))
+		lcd.Printf(1, "Dialing %s" , clean_to)
+		logger.Print("Dialing phonebook name: ", clean_to)
+		m.updateCall(func(r *callRecord) { r.Number = clean_to })
+		conn, err = dialName(clean_to)
 	} else { // ATD<modifier>
 
-		clean_to = r.Replace(to[2:])
+		// Hosts, passwords and stored number indexes aren't dial
+		// strings either
+		clean_to = strings.TrimSpace(strings.TrimSuffix(to[2:], ";"))
 		lcd.Printf(1, "Dialing %s" , clean_to)
 
 		switch cmd {
 		case 'H': // Hostname (ATDH hostname)
 			logger.Print("Opening telnet connection to: ", clean_to)
+			m.updateCall(func(r *callRecord) {
+				r.Host = clean_to
+				r.Protocol = "telnet"
+			})
 			conn, err = dialTelnet(clean_to, logger)
 		case 'E': // Encrypted host (ATDE hostname)
 			logger.Print("Opening SSH connection to: ", clean_to)
@@ -154,11 +329,15 @@ func dial(to string) error {
 				conn = nil
 				err = e
 			} else {
+				m.updateCall(func(r *callRecord) {
+					r.Host = host
+					r.Protocol = "ssh"
+				})
 				conn, err = dialSSH(host, logger, user, pw)
 			}
 		case 'T', 'P': // Fake number from address book (ATDT 5551212)
-			logger.Print("Dialing fake number: ", clean_to)
-			conn, err = dialNumber(clean_to)
+			logger.Print("Dialing fake number: ", to[1:])
+			conn, err = dialNumber(to[1:])
 		case 'S': // Stored number (ATDS3)
 			conn, err = dialStoredNumber(clean_to)
 		default:
@@ -169,19 +348,23 @@ func dial(to string) error {
 	}
 
 	if err == nil && conn == nil { // User aborted
+		logCall(OK, "aborted by DTE")
 		return OK	       // Return OK
 	}
 
 	// if there was an error, return a BUSY or NO_ANSWER result code.
 	if err != nil {
+		var result error
 		hangup()
 		if err == ERROR {
-			return ERROR
+			result = ERROR
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			result = NO_ANSWER
+		} else {
+			result = BUSY
 		}
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return NO_ANSWER
-		}
-		return BUSY
+		logCall(result, err.Error())
+		return result
 	}
 
 	// We're connected, setup the connected state in the modem. 
@@ -222,12 +405,32 @@ func parseDial(cmd string) (string, int, error) {
 	}
 
 	switch cmd[c] {
-	case 'T', 't', 'P', 'p': // Number dialing
+	case '"': // Quoted phonebook name (ATD"RETROBBS")
+		e := strings.Index(cmd[c+1:], "\"")
+		if e <= 0 {
+			return "", 0, fmt.Errorf("Bad phonebook name: %s", cmd)
+		}
+		name := cmd[c+1 : c+1+e]
+		i := c + 1 + e + 1 // D, quotes and the name
+		s = fmt.Sprintf("DN%s", name)
+		if i < len(cmd) && cmd[i] == ';' {
+			s += ";"
+			i++
+		}
+		return s, i, nil
+	case 'N', 'n': // Phonebook name (ATDN retrobbs)
+		name := strings.TrimSpace(cmd[c+1:])
+		if name == "" || name == ";" {
+			return "", 0, fmt.Errorf("Bad phonebook name: %s", cmd)
+		}
+		s = fmt.Sprintf("DN%s", name)
+		return s, len(cmd), nil
+	case 'T', 't', 'P', 'p': // Number dialing, tone or pulse
 		e := strings.LastIndexAny(cmd, "0123456789,;@!")
 		if e == -1 {
 			return "", 0, fmt.Errorf("Bad phone number: %s", cmd)
 		}
-		s = fmt.Sprintf("DT%s", cmd[2:e+1])
+		s = fmt.Sprintf("D%s", strings.ToUpper(cmd[1:2]) + cmd[2:e+1])
 		return s, len(s), nil
 	case 'H', 'h': // Host Dialing
 		s = fmt.Sprintf("DH%s", cmd[c+1:])
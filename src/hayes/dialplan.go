@@ -0,0 +1,295 @@
+package main
+
+// A dial plan sits in front of the phonebook.  Each rule matches the
+// dialed number against a pattern and either rewrites it (strip a prefix,
+// add a default area code) or maps it straight onto a host, so a whole
+// family of numbers doesn't need a phonebook entry apiece.
+//
+// Rules are tried in order.  A rewriting rule changes the number seen by
+// the rules after it; the first matching rule with a Host ends the search.
+// If no rule supplies a Host, the (possibly rewritten) number is looked up
+// in the phonebook.
+//
+// Patterns are matched against the sanitized number a character at a
+// time ('-', '(', ')' and spaces are ignored):
+//   0-9 A-D * #   match themselves
+//   X             matches any digit 0-9
+//   Z             matches 1-9
+//   N             matches 2-9
+//   [1-5] [137]   matches any digit in the set
+//   .             (at the end) matches one or more remaining characters
+//
+// Name, Host, Port, Username and Password are templates: {number} is
+// replaced by the number, {n} by its nth digit and {n-m} by its nth
+// through mth digits, counting from 1.
+//
+// Example:
+//   [ { "Pattern": "9.", "Strip": 1 },
+//     { "Pattern": "NXXXXXX", "Prepend": "508" },
+//     { "Pattern": "1800NXXXXXX", "Protocol": "telnet",
+//       "Host": "bbs{5-7}.example.com", "Port": "{8-11}" } ]
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type dialRule struct {
+	Pattern  string `json:"Pattern"`
+	Strip    int    `json:"Strip"`    // Leading digits to remove
+	Prepend  string `json:"Prepend"`  // Digits to add after stripping
+	Name     string `json:"Name"`     // Templates, used if Host is set
+	Host     string `json:"Host"`
+	Port     string `json:"Port"`
+	Protocol string `json:"Protocol"`
+	Username string `json:"Username"`
+	Password string `json:"Password"`
+}
+
+type Dialplan struct {
+	rules    []dialRule
+	filename string
+	log      *log.Logger
+}
+
+func NewDialplan(filename string, log *log.Logger) *Dialplan {
+	var d Dialplan
+	d.filename = filename
+	d.log = log
+	return &d
+}
+
+// Load the dial plan.  Having no dial plan file isn't an error, it just
+// means every number goes straight to the phonebook.
+func (d *Dialplan) Load() error {
+	d.rules = nil
+
+	b, err := ioutil.ReadFile(d.filename)
+	if os.IsNotExist(err) {
+		d.log.Printf("No dial plan file %s, using phonebook only",
+			d.filename)
+		return nil
+	}
+	if err != nil {
+		e := fmt.Errorf("Can't read dial plan file %s: %s",
+			d.filename, err)
+		d.log.Print(e)
+		return e
+	}
+
+	var rules []dialRule
+	if err = json.Unmarshal(b, &rules); err != nil {
+		d.log.Print(err)
+		return err
+	}
+
+	for i, r := range rules {
+		r.Pattern = normalizePattern(r.Pattern)
+		switch {
+		case r.Pattern == "":
+			err = fmt.Errorf("Dial plan rule %d: empty pattern", i)
+		case strings.Contains(r.Pattern[:len(r.Pattern)-1], "."):
+			err = fmt.Errorf("Dial plan rule %d: '.' must end the pattern",
+				i)
+		case r.Strip < 0:
+			err = fmt.Errorf("Dial plan rule %d: negative strip", i)
+		case r.Host != "" && !supportedProtocol(r.Protocol):
+			err = fmt.Errorf("Dial plan rule %d: unsupported protocol '%s'",
+				i, r.Protocol)
+		}
+		if err != nil {
+			d.log.Print(err)
+			return err
+		}
+		rules[i] = r
+	}
+	d.rules = rules
+	d.log.Printf("Loaded %d dial plan rules", len(d.rules))
+	return nil
+}
+
+func (d *Dialplan) String() string {
+	if len(d.rules) == 0 {
+		return "NO DIAL PLAN RULES\n"
+	}
+
+	var s string
+	for i, r := range d.rules {
+		s += fmt.Sprintf("%d=%s", i, r.Pattern)
+		if r.Strip > 0 {
+			s += fmt.Sprintf(" strip %d", r.Strip)
+		}
+		if r.Prepend != "" {
+			s += fmt.Sprintf(" prepend %s", r.Prepend)
+		}
+		if r.Host != "" {
+			s += fmt.Sprintf(" -> %s %s", r.Protocol, r.Host)
+			if r.Port != "" {
+				s += ":" + r.Port
+			}
+		}
+		s += "\n"
+	}
+	return s
+}
+
+// Apply the dial plan to number, returning the phonebook entry (real or
+// made up from a rule) to call.
+func (d *Dialplan) Resolve(number string) (pb_host, error) {
+	n, err := sanitizeNumber(number)
+	if err != nil {
+		return pb_host{}, err
+	}
+
+	for i, r := range d.rules {
+		if !matchPattern(r.Pattern, n) {
+			continue
+		}
+
+		if r.Strip > 0 || r.Prepend != "" {
+			strip := r.Strip
+			if strip > len(n) {
+				strip = len(n)
+			}
+			rewritten := r.Prepend + n[strip:]
+			d.log.Printf("Dial plan rule %d (%s): %s -> %s", i,
+				r.Pattern, n, rewritten)
+			n = rewritten
+		}
+
+		if r.Host != "" {
+			host := expandTemplate(r.Host, n)
+			if r.Port != "" {
+				host = net.JoinHostPort(host,
+					expandTemplate(r.Port, n))
+			}
+			d.log.Printf("Dial plan rule %d (%s): %s -> %s %s", i,
+				r.Pattern, n, r.Protocol, host)
+			return pb_host{
+				Phone:    n,
+				Name:     expandTemplate(r.Name, n),
+				Host:     host,
+				Protocol: r.Protocol,
+				Username: expandTemplate(r.Username, n),
+				Password: expandTemplate(r.Password, n),
+			}, nil
+		}
+	}
+
+	return phonebook.Lookup(n)
+}
+
+// Upper case a pattern and drop the punctuation people write phone
+// numbers with, leaving character sets alone.
+func normalizePattern(p string) string {
+	var s string
+	inSet := false
+	for _, c := range strings.ToUpper(p) {
+		switch {
+		case c == '[':
+			inSet = true
+		case c == ']':
+			inSet = false
+		case !inSet && strings.ContainsRune("-() ", c):
+			continue
+		}
+		s += string(c)
+	}
+	return s
+}
+
+// Does number match pattern?  See the top of this file for the syntax.
+func matchPattern(pattern, number string) bool {
+	i := 0
+	for p := 0; p < len(pattern); p++ {
+		c := pattern[p]
+		if c == '.' {
+			return i < len(number)
+		}
+		if i >= len(number) {
+			return false
+		}
+
+		d := number[i]
+		switch c {
+		case 'X':
+			if d < '0' || d > '9' {
+				return false
+			}
+		case 'Z':
+			if d < '1' || d > '9' {
+				return false
+			}
+		case 'N':
+			if d < '2' || d > '9' {
+				return false
+			}
+		case '[':
+			e := strings.IndexByte(pattern[p:], ']')
+			if e == -1 || !inDigitSet(pattern[p+1:p+e], d) {
+				return false
+			}
+			p += e
+		default:
+			if c != d {
+				return false
+			}
+		}
+		i++
+	}
+	return i == len(number)
+}
+
+// Is d in set, where set looks like "137" or "1-5"?
+func inDigitSet(set string, d byte) bool {
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			if d >= set[i] && d <= set[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if set[i] == d {
+			return true
+		}
+	}
+	return false
+}
+
+var templateRE = regexp.MustCompile(`\{(number|[0-9]+(-[0-9]+)?)\}`)
+
+// Replace {number}, {n} and {n-m} in t; see the top of this file.
+func expandTemplate(t string, number string) string {
+	return templateRE.ReplaceAllStringFunc(t, func(f string) string {
+		f = f[1 : len(f)-1]
+		if f == "number" {
+			return number
+		}
+
+		var from, to int
+		r := strings.SplitN(f, "-", 2)
+		from, _ = strconv.Atoi(r[0])
+		to = from
+		if len(r) == 2 {
+			to, _ = strconv.Atoi(r[1])
+		}
+		if from < 1 {
+			from = 1
+		}
+		if to > len(number) {
+			to = len(number)
+		}
+		if from > to {
+			return ""
+		}
+		return number[from-1 : to]
+	})
+}
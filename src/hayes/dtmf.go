@@ -278,29 +278,3 @@ func busyTone(count int) {
 		time.Sleep(500 * time.Millisecond)
 	}
 }
-
-func dialSounds(s string, keypressDelay, interkeyDelay time.Duration) {
-	if !flags.sound {
-		return 
-	}
-
-	for _, key := range s {
-		if key == ',' { 
-			delay := registers.Read(REG_COMMA_DELAY)
-			time.Sleep(time.Duration(delay) * time.Second) 
-			continue
-		}
-
-		t := getKeyTones(key)
-		t.Play(keypressDelay)
-		time.Sleep(interkeyDelay)
-	}
-}
-
-func simulateDTMF(s string) {
-	if !flags.sound {
-		return
-	}
-	DialTone.Play(250 * time.Millisecond)
-	dialSounds(s, 150 * time.Millisecond, 50 * time.Millisecond)
-}
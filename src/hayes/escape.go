@@ -0,0 +1,162 @@
+package main
+
+// Detecting the "+++" escape to command mode
+// (see http://www.messagestick.net/modem/Hayes_Ch1-4.html): the guard
+// time (S12, in 1/50ths of a second) of silence, three escape characters
+// (S2) each within the guard time of the last, and the guard time of
+// silence again.  Escape characters that might be the start of an escape
+// are held back until they're either part of one or proven to be data.
+// An S2 above 127 disables escaping.
+//
+// In TIES (time independent escape sequence) mode, S209=1, there are no
+// silences: "+++AT<command><CR>" escapes and runs the command, as long as
+// each character comes within the guard time of the last.  Anything else
+// is data.
+//
+// The detector doesn't read the clock itself; its callers pass in the
+// time, so it can be driven by a fake clock.
+
+import (
+	"strings"
+	"time"
+)
+
+// How often handleSerial() checks for the trailing guard time
+const __ESCAPE_TICK = 20 * time.Millisecond
+
+// Escape modes (S209)
+const (
+	ESCAPE_HAYES = iota
+	ESCAPE_TIES
+)
+
+var escapeModeNames = []string{"hayes", "ties"}
+
+// Longest TIES command line, "+++" and all
+const __MAX_TIES_CMD = 64
+
+type escapeDetector struct {
+	char    byte
+	guard   time.Duration
+	enabled bool
+	ties    bool
+	cr      byte
+	last    time.Time // When the DTE last sent anything
+	held    []byte    // Escape characters not yet sent on
+	command string    // The command from a TIES escape
+}
+
+func guardtime(gt byte) time.Duration {
+	return time.Duration(gt) * 20 * time.Millisecond
+}
+
+// Pick up S2, S12, S3 and S209
+func (e *escapeDetector) configure(s2, s12, s3, s209 byte) {
+	e.char = s2
+	e.enabled = s2 <= 127
+	e.guard = guardtime(s12)
+	e.cr = s3
+	e.ties = s209 == ESCAPE_TIES
+}
+
+// Is there at least the guard time between then and now?
+func (e *escapeDetector) quiet(now time.Time) bool {
+	return now.Sub(e.last) >= e.guard
+}
+
+// The DTE sent c at now, in data mode.  Returns true if that completed a
+// TIES escape (the command is in e.command), and what should be sent to
+// the remote, which may include escape characters held back before.
+func (e *escapeDetector) Feed(c byte, now time.Time) (bool, []byte) {
+	if e.ties {
+		return e.feedTIES(c, now)
+	}
+
+	var out []byte
+
+	if len(e.held) > 0 && (c != e.char || len(e.held) == 3 ||
+		(e.guard > 0 && e.quiet(now))) {
+		// Not an escape after all
+		out = e.held
+		e.held = nil
+	}
+
+	if e.enabled && c == e.char && (len(e.held) > 0 || e.quiet(now)) {
+		e.held = append(e.held, c)
+	} else {
+		out = append(out, c)
+	}
+	e.last = now
+	return false, out
+}
+
+func (e *escapeDetector) feedTIES(c byte, now time.Time) (bool, []byte) {
+	var out []byte
+
+	if len(e.held) > 0 && e.guard > 0 && e.quiet(now) {
+		out = e.held // Too slow, it was data
+		e.held = nil
+	}
+	e.last = now
+
+	n := len(e.held)
+	switch {
+	case !e.enabled:
+	case n < 3 && c == e.char,
+		n == 3 && (c == 'A' || c == 'a'),
+		n == 4 && (c == 'T' || c == 't'),
+		n >= 5 && c != e.cr && n < __MAX_TIES_CMD:
+		e.held = append(e.held, c)
+		return false, out
+	case n >= 5 && c == e.cr:
+		e.command = string(e.held[3:])
+		e.held = nil
+		return true, out
+	}
+
+	out = append(out, e.held...)
+	e.held = nil
+	return false, append(out, c)
+}
+
+// Time has passed.  Returns true if that completed an escape, and any
+// held escape characters that turned out to be data.
+func (e *escapeDetector) Tick(now time.Time) (bool, []byte) {
+	if len(e.held) == 0 || !e.quiet(now) {
+		return false, nil
+	}
+
+	held := e.held
+	e.held = nil
+	if len(held) == 3 && !e.ties {
+		e.command = ""
+		return true, nil
+	}
+	return false, held
+}
+
+// AT*esc[=hayes|ties]
+func setEscapeMode(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		mode := -1
+		for n, name := range escapeModeNames {
+			if name == strings.ToLower(cmd[i+1:]) {
+				mode = n
+			}
+		}
+		if registers.Set(REG_ESCAPE_MODE, mode) != OK {
+			return ERROR
+		}
+	}
+	serial.Printf("ESCAPE: %s, S2=%d, S12=%d\n",
+		strings.ToUpper(escapeModeNames[registers.Read(REG_ESCAPE_MODE)]),
+		registers.Read(REG_ESC_CH), registers.Read(REG_ESC_CODE_GUARD_TIME))
+	return OK
+}
+
+// The DTE sent something in command mode; nothing's held back there.
+func (e *escapeDetector) Reset(now time.Time) {
+	e.held = nil
+	e.last = now
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var escapeEpoch = time.Unix(1000, 0)
+
+func escapeAt(ms int) time.Time {
+	return escapeEpoch.Add(time.Duration(ms) * time.Millisecond)
+}
+
+type escapeEvent struct {
+	ms int // When the DTE sent c
+	c  byte
+}
+
+// Run the events through a detector, ticking every __ESCAPE_TICK as
+// handleSerial() does, until end.  Returns whether it escaped, the TIES
+// command, and everything sent to the remote.
+func runEscape(e *escapeDetector, events []escapeEvent, end int) (bool,
+	string, []byte) {
+	var out []byte
+	escaped := false
+	tick := int(__ESCAPE_TICK / time.Millisecond)
+
+	e.Reset(escapeEpoch)
+	i := 0
+	for ms := 0; ms <= end; ms += tick {
+		for ; i < len(events) && events[i].ms <= ms; i++ {
+			x, data := e.Feed(events[i].c, escapeAt(events[i].ms))
+			out = append(out, data...)
+			escaped = escaped || x
+		}
+		x, data := e.Tick(escapeAt(ms))
+		out = append(out, data...)
+		escaped = escaped || x
+	}
+	return escaped, e.command, out
+}
+
+// Each character of s, gap milliseconds apart, starting at start
+func escapeString(s string, start, gap int) []escapeEvent {
+	var ev []escapeEvent
+	for i := 0; i < len(s); i++ {
+		ev = append(ev, escapeEvent{start + i*gap, s[i]})
+	}
+	return ev
+}
+
+func TestEscapeDetector(t *testing.T) {
+	tests := []struct {
+		name    string
+		s2      byte
+		s209    byte
+		events  []escapeEvent
+		escaped bool
+		command string
+		out     string
+	}{
+		{
+			name:    "guard times before and after",
+			s2:      '+',
+			events:  escapeString("+++", 1500, 100),
+			escaped: true,
+		},
+		{
+			name: "no guard time before",
+			s2:   '+',
+			events: append(escapeString("a", 1000, 0),
+				escapeString("+++", 1500, 100)...),
+			out: "a+++",
+		},
+		{
+			name: "no guard time after",
+			s2:   '+',
+			events: append(escapeString("+++", 1500, 100),
+				escapeString("x", 2000, 0)...),
+			out: "+++x",
+		},
+		{
+			name:   "four escape characters are data",
+			s2:     '+',
+			events: escapeString("++++", 1500, 100),
+			out:    "++++",
+		},
+		{
+			name: "slow third escape character",
+			s2:   '+',
+			events: append(escapeString("++", 1500, 100),
+				escapeString("+", 2800, 0)...),
+			out: "+++",
+		},
+		{
+			name:   "held characters released as data",
+			s2:     '+',
+			events: escapeString("++", 1500, 100),
+			out:    "++",
+		},
+		{
+			name:   "S2 above 127 disables escaping",
+			s2:     200,
+			events: escapeString("\xc8\xc8\xc8", 1500, 100),
+			out:    "\xc8\xc8\xc8",
+		},
+		{
+			name:    "TIES escape with a command",
+			s2:      '+',
+			s209:    ESCAPE_TIES,
+			events:  escapeString("x+++ATH\r", 0, 10),
+			escaped: true,
+			command: "ATH",
+			out:     "x",
+		},
+		{
+			name:   "TIES bare escape is data",
+			s2:     '+',
+			s209:   ESCAPE_TIES,
+			events: escapeString("+++", 1500, 100),
+			out:    "+++",
+		},
+		{
+			name:   "TIES escape characters then data",
+			s2:     '+',
+			s209:   ESCAPE_TIES,
+			events: escapeString("+++ok", 1500, 100),
+			out:    "+++ok",
+		},
+	}
+
+	for _, tc := range tests {
+		var e escapeDetector
+		e.configure(tc.s2, 50, '\r', tc.s209) // 1 second guard time
+		escaped, command, out := runEscape(&e, tc.events, 5000)
+		if escaped != tc.escaped {
+			t.Errorf("%s: escaped %v, want %v", tc.name, escaped,
+				tc.escaped)
+		}
+		if escaped && command != tc.command {
+			t.Errorf("%s: command %q, want %q", tc.name, command,
+				tc.command)
+		}
+		if string(out) != tc.out {
+			t.Errorf("%s: sent %q, want %q", tc.name, out, tc.out)
+		}
+	}
+}
+
+// Anything typed in command mode counts as activity, and drops whatever
+// was held back.
+func TestEscapeReset(t *testing.T) {
+	var e escapeDetector
+	e.configure('+', 50, '\r', ESCAPE_HAYES)
+	e.Reset(escapeEpoch)
+
+	if _, out := e.Feed('+', escapeAt(1500)); len(out) != 0 {
+		t.Fatalf("escape character sent as %q, not held", out)
+	}
+	e.Reset(escapeAt(1600))
+
+	// The guard time runs from the Reset, so these are data
+	for i, ms := range []int{2000, 2100, 2200} {
+		if _, out := e.Feed('+', escapeAt(ms)); string(out) != "+" {
+			t.Errorf("escape character %d sent as %q", i, out)
+		}
+	}
+	if escaped, out := e.Tick(escapeAt(5000)); escaped || len(out) != 0 {
+		t.Errorf("after Reset: escaped %v, sent %q", escaped, out)
+	}
+}
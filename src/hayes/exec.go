@@ -0,0 +1,154 @@
+package main
+
+// The "exec" protocol connects a call to a local program (a Kermit
+// server, a BBS binary, a shell for trusted users) running on a
+// pseudo-terminal.  The entry's Host is the program, Args its arguments,
+// Env extra KEY=value environment variables and Dir the directory to run
+// it in.  Hanging up kills the program's process group; the program
+// exiting drops carrier.
+
+import (
+	"code.cloudfoundry.org/bytefmt"
+	"fmt"
+	"github.com/creack/pty"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long a program gets to exit after SIGHUP before it's killed
+const __EXEC_KILL_WAIT = 2 * time.Second
+
+// Implements connection for a local program
+type execConn struct {
+	mode    bool
+	cmd     *exec.Cmd
+	pty     *os.File
+	sent    uint64
+	recv    uint64
+	exited  chan struct{}
+	started time.Time
+}
+
+func dialExec(entry pb_host, log *log.Logger) (connection, error) {
+	cmd := exec.Command(entry.Host, entry.Args...)
+	cmd.Dir = entry.Dir
+	cmd.Env = append(os.Environ(), "TERM=xterm")
+	cmd.Env = append(cmd.Env, entry.Env...)
+
+	log.Printf("Starting: %s %s", entry.Host, strings.Join(entry.Args, " "))
+
+	// pty.Start() puts the program in its own session, so it and
+	// anything it starts can be killed as a process group.
+	cols, rows := terminalSize(&entry)
+	f, err := pty.StartWithSize(cmd,
+		&pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return nil, err
+	}
+
+	e := &execConn{
+		mode:    DATAMODE,
+		cmd:     cmd,
+		pty:     f,
+		exited:  make(chan struct{}),
+		started: time.Now(),
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("%s (pid %d) exited: %v", entry.Host,
+			cmd.Process.Pid, err)
+		close(e.exited)
+	}()
+
+	log.Printf("Started %s, pid %d", entry.Host, cmd.Process.Pid)
+	return e, nil
+}
+
+func (e *execConn) Read(p []byte) (int, error) {
+	i, err := e.pty.Read(p)
+	e.recv += uint64(i)
+
+	// Linux returns EIO once the program has exited and closed its
+	// side of the pty.
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EIO {
+		err = io.EOF
+	}
+	return i, err
+}
+
+func (e *execConn) Write(p []byte) (int, error) {
+	i, err := e.pty.Write(p)
+	if err != nil {
+		logger.Print(err)
+	}
+	e.sent += uint64(i)
+	return i, err
+}
+
+// Hang up on the program: SIGHUP its process group, then SIGKILL if it
+// hasn't gone in __EXEC_KILL_WAIT.
+func (e *execConn) Close() error {
+	pid := e.cmd.Process.Pid
+
+	select {
+	case <-e.exited:
+	default:
+		logger.Printf("Hanging up on %s (pid %d)", e.cmd.Path, pid)
+		syscall.Kill(-pid, syscall.SIGHUP)
+		select {
+		case <-e.exited:
+		case <-time.After(__EXEC_KILL_WAIT):
+			logger.Printf("Killing %s (pid %d)", e.cmd.Path, pid)
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}
+	return e.pty.Close()
+}
+
+func (e *execConn) RemoteAddr() net.Addr {
+	return pseudoAddr{"exec", e.cmd.Path}
+}
+
+func (e *execConn) Direction() int {
+	return OUTBOUND
+}
+
+func (e *execConn) Mode() bool {
+	return e.mode
+}
+
+func (e *execConn) SetMode(mode bool) {
+	e.mode = mode
+}
+
+func (e *execConn) Stats() (uint64, uint64) {
+	return e.sent, e.recv
+}
+
+func (e *execConn) String() string {
+	return ">exec:" + e.cmd.Path
+}
+
+func (e *execConn) DebugInfo() string {
+	sent, recv := e.Stats()
+	return fmt.Sprintf("Program %s (pid %d), up %s, sent %s, received %s",
+		strings.Join(e.cmd.Args, " "), e.cmd.Process.Pid,
+		time.Since(e.started).Round(time.Second),
+		bytefmt.ByteSize(sent), bytefmt.ByteSize(recv))
+}
+
+// Not every platform can set deadlines on a pty; without them S30
+// doesn't apply to exec calls.
+func (e *execConn) SetDeadline(t time.Time) error {
+	if err := e.pty.SetDeadline(t); err != nil && err != os.ErrNoDeadline {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+// V.250 extended ("+") commands: identity (+GMI, +GMM, +GMR, +GCAP, from
+// the personality) and
+// the DTE interface (+IPR, +ICF, +IFC).  Each can be tested (AT+X=?),
+// read (AT+X?), set (AT+X=a,b) or executed (AT+X), as the command allows,
+// and several can be strung together with ';'.
+
+import (
+	"fmt"
+	tarmserial "github.com/tarm/serial"
+	"strconv"
+	"strings"
+)
+
+type extendedCmd struct {
+	test string                 // Reply to =?
+	read func() string          // Reply to ?
+	set  func(args []int) error // =, with -1 for missing arguments
+	exec func() error
+}
+
+var extendedCmds = map[string]extendedCmd{
+	"+GMI":  {exec: func() error { return info(pers.Manufacturer) }},
+	"+GMM":  {exec: func() error { return info(pers.Model) }},
+	"+GMR":  {exec: func() error { return info(pers.Revision) }},
+	"+GCAP": {exec: func() error { return info("+GCAP: +I") }},
+	"+IPR": {
+		test: "+IPR: (),(300,1200,2400,4800,9600,19200,38400,57600,115200,230400)",
+		read: readIPR,
+		set:  setIPR,
+	},
+	"+ICF": {
+		test: "+ICF: (1-6),(0,1)",
+		read: readICF,
+		set:  setICF,
+	},
+	"+IFC": {
+		test: "+IFC: (0-2),(0-2)",
+		read: readIFC,
+		set:  setIFC,
+	},
+}
+
+func info(s string) error {
+	serial.Println(s)
+	return OK
+}
+
+// Parse AT+...  Returns the command, from the '+' up to (not including)
+// any ';' that ends it, upper cased.
+func parseExtended(cmd string) (string, int, error) {
+	end := strings.IndexByte(cmd, ';')
+	n := end + 1
+	if end == -1 {
+		end, n = len(cmd), len(cmd)
+	}
+	s := strings.ToUpper(cmd[:end])
+
+	name := s
+	if i := strings.IndexAny(s, "=?"); i != -1 {
+		name = s[:i]
+	}
+	if _, ok := extendedCmds[name]; !ok {
+		logger.Printf("Unknown extended command: %s", cmd)
+		return "", 0, fmt.Errorf("Bad command: %s", cmd)
+	}
+	return s, n, nil
+}
+
+// Run a command from parseExtended()
+func extendedCommand(cmd string) error {
+	name, arg := cmd, ""
+	if i := strings.IndexAny(cmd, "=?"); i != -1 {
+		name, arg = cmd[:i], cmd[i:]
+	}
+	c := extendedCmds[name]
+
+	switch {
+	case arg == "=?":
+		if c.test != "" {
+			serial.Println(c.test)
+		}
+		return OK
+
+	case arg == "?":
+		if c.read == nil {
+			return ERROR
+		}
+		serial.Println(c.read())
+		return OK
+
+	case arg == "":
+		if c.exec == nil {
+			return ERROR
+		}
+		return c.exec()
+
+	case arg[0] == '=' && c.set != nil:
+		var args []int
+		for _, a := range strings.Split(arg[1:], ",") {
+			if a == "" {
+				args = append(args, -1)
+				continue
+			}
+			n, err := strconv.Atoi(a)
+			if err != nil || n < 0 {
+				return ERROR
+			}
+			args = append(args, n)
+		}
+		return c.set(args)
+	}
+	return ERROR
+}
+
+// Argument i, or def if it's missing
+func argOr(args []int, i int, def int) int {
+	if i >= len(args) || args[i] == -1 {
+		return def
+	}
+	return args[i]
+}
+
+// AT+IPR: DTE speed.  0 (autobaud) isn't supported.
+func readIPR() string {
+	return fmt.Sprintf("+IPR: %d", serial.Config().Baud)
+}
+
+func setIPR(args []int) error {
+	c := serial.Config()
+	baud := argOr(args, 0, c.Baud)
+	if len(args) > 1 {
+		return ERROR
+	}
+	switch baud {
+	case 300, 1200, 2400, 4800, 9600, 19200, 38400, 57600, 115200, 230400:
+	default:
+		return ERROR
+	}
+	c.Baud = baud
+	serial.SetConfig(c)
+	return OK
+}
+
+// AT+ICF: DTE framing, as <format>,<parity>.  Formats are 1 8N2, 2 8P1,
+// 3 8N1, 4 7N2, 5 7P1, 6 7N1 (P is the parity bit); parity is 0 odd or
+// 1 even.  Mark and space parity can't be set on Linux.
+var icfFormats = [...]struct {
+	size   byte
+	parity bool
+	stop   tarmserial.StopBits
+}{
+	1: {8, false, tarmserial.Stop2},
+	2: {8, true, tarmserial.Stop1},
+	3: {8, false, tarmserial.Stop1},
+	4: {7, false, tarmserial.Stop2},
+	5: {7, true, tarmserial.Stop1},
+	6: {7, false, tarmserial.Stop1},
+}
+
+func readICF() string {
+	c := serial.Config()
+	format, parity := 3, 1
+	for i := 1; i < len(icfFormats); i++ {
+		f := icfFormats[i]
+		if f.size == c.Size && f.stop == c.StopBits &&
+			f.parity == (c.Parity != tarmserial.ParityNone) {
+			format = i
+			break
+		}
+	}
+	if c.Parity == tarmserial.ParityOdd {
+		parity = 0
+	}
+	return fmt.Sprintf("+ICF: %d,%d", format, parity)
+}
+
+func setICF(args []int) error {
+	c := serial.Config()
+	if len(args) > 2 {
+		return ERROR
+	}
+	format := argOr(args, 0, 3)
+	parity := argOr(args, 1, 1)
+	if format < 1 || format >= len(icfFormats) || parity > 1 {
+		return ERROR
+	}
+
+	f := icfFormats[format]
+	c.Size, c.StopBits, c.Parity = f.size, f.stop, tarmserial.ParityNone
+	if f.parity {
+		c.Parity = tarmserial.ParityEven
+		if parity == 0 {
+			c.Parity = tarmserial.ParityOdd
+		}
+	}
+	serial.SetConfig(c)
+	return OK
+}
+
+// AT+IFC: flow control, as <how the DTE stops us>,<how we stop the DTE>:
+// 0 none, 1 XON/XOFF, 2 RTS/CTS.
+func readIFC() string {
+	dceByDTE, dteByDCE := serial.FlowControl()
+	return fmt.Sprintf("+IFC: %d,%d", dceByDTE, dteByDCE)
+}
+
+func setIFC(args []int) error {
+	dceByDTE, dteByDCE := serial.FlowControl()
+	if len(args) > 2 {
+		return ERROR
+	}
+	dceByDTE = argOr(args, 0, dceByDTE)
+	dteByDCE = argOr(args, 1, dteByDCE)
+	if dceByDTE > FLOW_RTSCTS || dteByDCE > FLOW_RTSCTS {
+		return ERROR
+	}
+	serial.SetFlowControl(dceByDTE, dteByDCE)
+	return OK
+}
@@ -4,14 +4,20 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 const (
 	__ADDRESS_BOOK_FILE = "./addressbook.json"
+	__DIAL_PLAN_FILE    = "./dialplan.json"
 	__ID_RSA_FILE       = "./id_rsa"
 	__SERIAL_SPEED      = 115200
 	__TELNET_PORT       = 20000
 	__SSHD_PORT         = 22000
+	__CALL_LOG_FILE     = "./calls.log"
+	__CALL_LOG_SIZE     = 1024 * 1024
+	__RECORD_DIR        = "./recordings"
+	__PROFILES_FILE     = "./hayes.config.json"
 )
 
 var flags struct {
@@ -20,6 +26,7 @@ var flags struct {
 	serialPort  string
 	serialSpeed int
 	phoneBook   string
+	dialPlan    string
 	telnetPort  uint
 	sshdPort    uint
 	privateKey  string
@@ -27,6 +34,21 @@ var flags struct {
 	ssh         bool
 	sound       bool
 	lcd         bool
+	callLog     string
+	callLogSize int64
+	metrics     string
+	api         string
+	apiToken    string
+	record      bool
+	recordDir   string
+	recordFmt   string
+	personality string
+	persDir     string
+	profiles    string
+	configFile  string
+	printConfig bool
+	pins        map[string]int // GPIOs, from the config file
+	history     string
 }
 
 func initFlags() {
@@ -50,6 +72,9 @@ func initFlags() {
 	flag.StringVar(&flags.phoneBook, "addressbook", __ADDRESS_BOOK_FILE,
 		"Address Book `file`")
 
+	flag.StringVar(&flags.dialPlan, "dialplan", __DIAL_PLAN_FILE,
+		"Dial plan `file`")
+
 	flag.UintVar(&flags.telnetPort, "telnetport", __TELNET_PORT,
 		"Network `port` number for inbound telnet sessions")
 
@@ -71,5 +96,60 @@ func initFlags() {
 	flag.BoolVar(&flags.lcd, "lcd", false,
 		"Use LCD (default false)")
 
+	flag.StringVar(&flags.callLog, "calllog", __CALL_LOG_FILE,
+		"Call log `file` (empty to disable)")
+
+	flag.Int64Var(&flags.callLogSize, "calllogsize", __CALL_LOG_SIZE,
+		"Rotate the call log when it reaches `bytes`")
+
+	flag.StringVar(&flags.metrics, "metrics", "",
+		"Serve Prometheus metrics on `address` (eg, :9273)")
+
+	flag.StringVar(&flags.api, "api", "",
+		"Serve the management API on `address` (eg, 127.0.0.1:8023)")
+
+	flag.StringVar(&flags.apiToken, "apitoken", "",
+		"Bearer `token` required by the management API")
+
+	flag.BoolVar(&flags.record, "record", false,
+		"Record every call (default false)")
+
+	flag.StringVar(&flags.recordDir, "recorddir", __RECORD_DIR,
+		"Save call recordings in `directory`")
+
+	flag.StringVar(&flags.recordFmt, "recordformat", "asciicast",
+		"Call recording `format` (asciicast or ttyrec)")
+
+	flag.StringVar(&flags.personality, "personality", __PERSONALITY,
+		"Modem `personality` (hayes, usr, v34 or one from -personalities)")
+
+	flag.StringVar(&flags.persDir, "personalities", __PERSONALITY_DIR,
+		"Load modem personalities from the JSON files in `directory`")
+
+	flag.StringVar(&flags.profiles, "profiles", __PROFILES_FILE,
+		"Stored profiles `file` (AT&W, ATZ, AT&Y)")
+
+	flag.StringVar(&flags.history, "history", "",
+		"Keep the command history in `file` (default none)")
+
+	flag.StringVar(&flags.configFile, "config", "",
+		"Read settings from JSON config `file`")
+
+	flag.BoolVar(&flags.printConfig, "print-config", false,
+		"Print the settings in effect and exit")
+
 	flag.Parse()
+	loadSettings()
+
+	switch strings.ToLower(flags.recordFmt) {
+	case "asciicast", "ttyrec":
+	default:
+		settingsError("Unknown recording format '%s' (asciicast or ttyrec)",
+			flags.recordFmt)
+	}
+
+	if flags.printConfig {
+		printSettings()
+		os.Exit(0)
+	}
 }
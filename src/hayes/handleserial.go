@@ -1,85 +1,72 @@
 package main
 
 import (
+	"fmt"
 	"time"
 )
 
-var guardTimer *time.Ticker
-
-func guardtime(gt int) time.Duration {
-	return time.Duration(float64(gt) * 20) * time.Millisecond
-}
-
-func resetGuardCodeTimer(guard_time int) {
-	stopGuardCodeTimer()
-	gt := guardtime(guard_time)
-	logger.Printf("Resetting escape code timer for %v", gt)
-	guardTimer = time.NewTicker(gt)
-}
-
-func stopGuardCodeTimer() {
-	if guardTimer != nil {
-		guardTimer.Stop()
-	}
-}
-
-func startGuardCodeTimer() {
-	if guardTimer != nil {
-		panic("Can't have more than one Escape Code timer")
-	}
-	gt := int(registers.Read(REG_ESC_CODE_GUARD_TIME))
-	resetGuardCodeTimer(gt)
-}
-
 // Consume bytes from the serial port and process, or send to remote as
 // per conf.mode
 func handleSerial() {
 	var c, CR, BS byte
-	var s string
-	var lastThree [3]byte
-	var idx int
-	var countAtTick, countAtLastTick uint64
-	var waitForOneTick bool
+	var esc escapeDetector
+
+	// Echo what's typed in command mode if ATE1
+	ed := newLineEditor(func(p []byte) {
+		if conf.echoInCmdMode {
+			serial.Write(p)
+		}
+	})
+
+	// After a command, start the next line; AT*hist=n may have put
+	// a command on it
+	nextLine := func() {
+		ed.reset(history.takePreload())
+	}
+
+	tick := time.NewTicker(__ESCAPE_TICK)
+	defer tick.Stop()
 
 	// Start accepting and processing bytes from the DTE
-	countAtTick = 0
 	for {
+		esc.configure(registers.Read(REG_ESC_CH),
+			registers.Read(REG_ESC_CODE_GUARD_TIME),
+			registers.Read(REG_CR_CH), registers.Read(REG_ESCAPE_MODE))
 
 		select {
-		case <-guardTimer.C:
+		case now := <-tick.C:
 			if m.getMode() == COMMANDMODE { // Skip if in COMMAND mode
 				continue
 			}
 
-			// Look for the command escape sequence
-			// (see http://www.messagestick.net/modem/Hayes_Ch1-4.html)
-			// Basically:
-			//   1s of silence, "+++", 1s of silence.
-			// So, count the incoming chars between ticks, saving
-			// the previous tick's count.  If you see
-			// countAtTick == 3 && CountAtLastTick == 0 && the last
-			// three characters are "+++", wait one more tick.  If
-			// countAtTick == 0, the guard sequence was detected.
-
-			if countAtTick == 3 && countAtLastTick == 0 &&
-				lastThree == escSequence {
-				waitForOneTick = true
-			} else if waitForOneTick && countAtTick == 0 {
+			escaped, data := esc.Tick(now)
+			sendToRemote(data)
+			if escaped {
 				logger.Print("Escape sequence detected, ",
 					"entering command mode")
 				m.setMode(COMMANDMODE)
 				prstatus(OK)
-				s = ""
-				continue
-			} else {
-				waitForOneTick = false
+				nextLine()
+			}
+			continue
+
+		case d := <-apiDials:
+			switch {
+			case m.getMode() != COMMANDMODE, m.offHook(),
+				m.getLineBusy():
+				d.accepted <- fmt.Errorf("Line busy")
+			case len(ed.line) > 0:
+				d.accepted <- fmt.Errorf("DTE is typing a command")
+			default:
+				d.accepted <- nil
+				serial.Println(d.cmd)
+				prstatus(runCommand(d.cmd))
+				serial.Reconfigure()
+				nextLine()
 			}
-			countAtLastTick = countAtTick
-			countAtTick = 0
 			continue
 
 		case c = <-serial.channel:
-			countAtTick++
 		}
 
 		// Syntatic helpers.  Reload each time we loop
@@ -88,54 +75,65 @@ func handleSerial() {
 
 		switch m.getMode() {
 		case COMMANDMODE:
-			if conf.echoInCmdMode { // Echo back to the DTE
-				serial.WriteByte(c)
-			}
-
-			// Accumulate chars from 'c' in 's' until we read a CR, then process
-			// s as a command.
+			esc.Reset(time.Now())
 
 			// 'A/' command, immediately exec.
-			switch {
-			case  (s == "A" || s == "a") && c == '/':
+			if ed.repeat(c) {
 				serial.Println()
 				if m.lastCmd == "" {
 					prstatus(ERROR)
 				} else {
 					err := runCommand(m.lastCmd)
 					prstatus(err)
+					serial.Reconfigure()
 				}
-				s = ""
+				nextLine()
+				continue
+			}
 
-			case c == CR && s != "":
+			// Edit the line until CR, then process it as a command.
+			if s, ok := ed.Feed(c, CR, BS); ok {
 				err := runCommand(s)
 				prstatus(err)
-				s = ""
-
-			case c == BS && len(s) > 0:
-				s = s[0 : len(s)-1]
-
-			case c == CR || c == BS && len(s) == 0:
-				// ignore naked CR's & BS if s is already empty
-
-			default:
-				s += string(c)
+				serial.Reconfigure()
+				nextLine()
 			}
 
 		case DATAMODE:
-			// Save the last three characters, it might be the command escape sequence
-			lastThree[idx] = c
-			idx = (idx + 1) % 3
-
-			// Send to remote, blinking the SD LED
-			if m.offHook() && m.conn != nil {
-				led_SD_on()
-				out := make([]byte, 1)
-				out[0] = c
-				m.conn.Write(out)
-				led_SD_off()
+			// Escape characters are held back until we know they
+			// aren't the command escape sequence
+			escaped, data := esc.Feed(c, time.Now())
+			sendToRemote(data)
+			if escaped { // TIES, run the command
+				logger.Printf("TIES escape, running %s", esc.command)
+				m.setMode(COMMANDMODE)
+				serial.Println()
+				err := runCommand(esc.command)
+				prstatus(err)
+				serial.Reconfigure()
+				nextLine()
 			}
 		}
 	}
 }
 
+// Send data from the DTE to the remote, blinking the SD LED
+func sendToRemote(p []byte) {
+	conn := m.getConn()
+	if len(p) == 0 || !m.offHook() || conn == nil {
+		return
+	}
+
+	led_SD_on()
+	for _, c := range p {
+		if echo := localEcho(c); len(echo) > 0 {
+			serial.Write(echo)
+		}
+		out := translateFromDTE([]byte{c})
+		if len(out) > 0 {
+			conn.Write(out)
+			recordInput(out)
+		}
+	}
+	led_SD_off()
+}
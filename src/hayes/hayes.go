@@ -25,9 +25,11 @@ var m Modem
 var conf *Config
 var registers *Registers
 var phonebook *Phonebook
+var dialplan *Dialplan
 var profiles *storedProfiles
 var serial *serialPort
 var callChannel chan connection
+var calls *callLog
 var lcd *lcdm.Lcd
 
 // Catch ^C, reset the HW pins
@@ -93,6 +95,12 @@ func main() {
 	soundInit()
 
 	// Setup modem inital state
+	history.load(flags.history)
+	loadPersonalities(flags.persDir)
+	if err := setPersonality(flags.personality); err != nil {
+		logger.Print(err)
+		setPersonality(__PERSONALITY)
+	}
 	conf = &Config{}
 	registers = NewRegisters()
 	factoryReset()
@@ -101,9 +109,18 @@ func main() {
 	setupHW()
 
 	// Setup the comms channels and handle inbound/outbound comms
+	calls = newCallLog(flags.callLog, flags.callLogSize, logger)
+	recording.enabled = flags.record
 	callChannel = make(chan connection)
 	go handleCalls()
 
+	if flags.metrics != "" {
+		go serveMetrics(flags.metrics)
+	}
+	if flags.api != "" {
+		go serveAPI(flags.api, flags.apiToken)
+	}
+
 	time.Sleep(500 * time.Millisecond)
 
 	// Tell user & DTE we're ready
@@ -49,7 +49,8 @@ func handlePins() {
 		if conf.dcdPinned { // DCD is pinned high
 			raiseCD()
 		} else {
-			switch m.getdcd() { // DCD is set by m.dcd
+			// DCD is set by m.dcd, and drops while the carrier's lost
+			switch m.getdcd() && !m.getCarrierLost() {
 			case true:  raiseCD()
 			case false: lowerCD()
 			}
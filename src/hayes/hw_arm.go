@@ -47,9 +47,34 @@ const (
 	DTR_PIN = 16 // Data Terminal Ready (Input)
 )
 
+// Names for the config file's "pins"
+var pinNames = map[string]int{
+	"HS_LED": HS_LED, "AA_LED": AA_LED, "TR_LED": TR_LED,
+	"OH_LED": OH_LED, "RD_LED": RD_LED, "SD_LED": SD_LED,
+	"CS_LED": CS_LED, "RI_LED": RI_LED, "CD_LED": CD_LED,
+	"MR_LED": MR_LED, "CTS_PIN": CTS_PIN, "RI_PIN": RI_PIN,
+	"CD_PIN": CD_PIN, "DSR_PIN": DSR_PIN, "RTS_PIN": RTS_PIN,
+	"DTR_PIN": DTR_PIN,
+}
+
+// The GPIO for pin, unless the config file moved it
+func gpio(pin int) rpio.Pin {
+	for name, p := range pinNames {
+		if n, ok := flags.pins[name]; ok && p == pin {
+			logger.Printf("%s is on GPIO %d", name, n)
+			return rpio.Pin(n)
+		}
+	}
+	return rpio.Pin(pin)
+}
+
 func setupPins() {
 	hwlock.Lock()
 
+	for _, name := range unknownPins(pinNames) {
+		logger.Printf("Unknown pin %s in config", name)
+	}
+
 	if err := rpio.Open(); err != nil {
 		logger.Fatal("Fatal Error: ", err)
 	}
@@ -58,53 +83,53 @@ func setupPins() {
 	pins = make(hwPins)
 
 	// LEDs
-	leds[HS_LED] = rpio.Pin(HS_LED)
+	leds[HS_LED] = gpio(HS_LED)
 	leds[HS_LED].Output()
 
-	leds[AA_LED] = rpio.Pin(AA_LED)
+	leds[AA_LED] = gpio(AA_LED)
 	leds[AA_LED].Output()
 
-	leds[RI_LED] = rpio.Pin(RI_LED)
+	leds[RI_LED] = gpio(RI_LED)
 	leds[RI_LED].Output()
 
-	leds[MR_LED] = rpio.Pin(MR_LED)
+	leds[MR_LED] = gpio(MR_LED)
 	leds[MR_LED].Output()
 
-	leds[TR_LED] = rpio.Pin(TR_LED)
+	leds[TR_LED] = gpio(TR_LED)
 	leds[TR_LED].Output()
 
-	leds[RD_LED] = rpio.Pin(RD_LED)
+	leds[RD_LED] = gpio(RD_LED)
 	leds[RD_LED].Output()
 
-	leds[CS_LED] = rpio.Pin(CS_LED)
+	leds[CS_LED] = gpio(CS_LED)
 	leds[CS_LED].Output()
 
-	leds[OH_LED] = rpio.Pin(OH_LED)
+	leds[OH_LED] = gpio(OH_LED)
 	leds[OH_LED].Output()
 
-	leds[CD_LED] = rpio.Pin(CD_LED)
+	leds[CD_LED] = gpio(CD_LED)
 	leds[CD_LED].Output()
 
-	leds[SD_LED] = rpio.Pin(SD_LED)
+	leds[SD_LED] = gpio(SD_LED)
 	leds[SD_LED].Output()
 
 	// Pins
-	pins[CTS_PIN] = rpio.Pin(CTS_PIN)
+	pins[CTS_PIN] = gpio(CTS_PIN)
 	pins[CTS_PIN].Output()
 
-	pins[RI_PIN] = rpio.Pin(RI_PIN)
+	pins[RI_PIN] = gpio(RI_PIN)
 	pins[RI_PIN].Output()
 
-	pins[CD_PIN] = rpio.Pin(CD_PIN)
+	pins[CD_PIN] = gpio(CD_PIN)
 	pins[CD_PIN].Output()
 
-	pins[DSR_PIN] = rpio.Pin(DSR_PIN)
+	pins[DSR_PIN] = gpio(DSR_PIN)
 	pins[DSR_PIN].Output()
 
-	pins[DTR_PIN] = rpio.Pin(DTR_PIN)
+	pins[DTR_PIN] = gpio(DTR_PIN)
 	pins[DTR_PIN].Input()
 
-	pins[RTS_PIN] = rpio.Pin(RTS_PIN)
+	pins[RTS_PIN] = gpio(RTS_PIN)
 	pins[RTS_PIN].Input()
 
 	hwlock.Unlock()
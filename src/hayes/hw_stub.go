@@ -41,6 +41,9 @@ var lock sync.RWMutex
 func setupPins() {
 	logger.Printf("Simulated Pins enabled on %s/%s\n",
 		runtime.GOOS, runtime.GOARCH)
+	if len(flags.pins) > 0 {
+		logger.Print("Simulated pins, ignoring the config's pins")
+	}
 
 	clearPins()
 
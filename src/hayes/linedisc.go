@@ -0,0 +1,195 @@
+package main
+
+// Data mode line discipline: what ends a line in each direction, NUL
+// padding after CR for slow printers, and local echo for machines that
+// expect the modem to echo what they type.
+//
+//   S205  Line ends sent to the DTE        0 none (as sent), 1 cr, 2 lf,
+//   S206  Line ends sent to the host       3 crlf, 4 striplf
+//   S207  NULs sent to the DTE after each CR
+//   S208  Local echo in data mode (0 off, 1 on)
+//
+// With cr, lf or crlf, a CR, LF or CRLF in the data all end a line and
+// are replaced; striplf just drops LFs.  The phonebook entry's
+// "DTELineEnd", "HostLineEnd", "CRPadding" and "LocalEcho" override the
+// registers.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// More NULs than this is no longer padding
+const __MAX_CR_PAD = 32
+
+const (
+	EOL_NONE = iota
+	EOL_CR
+	EOL_LF
+	EOL_CRLF
+	EOL_STRIPLF
+)
+
+var eolNames = []string{"none", "cr", "lf", "crlf", "striplf"}
+
+func eolName(e byte) string {
+	if int(e) < len(eolNames) {
+		return eolNames[e]
+	}
+	return "unknown"
+}
+
+func eolByName(name string) (byte, bool) {
+	name = strings.ToLower(name)
+	for i, n := range eolNames {
+		if n == name {
+			return byte(i), true
+		}
+	}
+	return EOL_NONE, false
+}
+
+// Implements stage for line endings and padding
+type lineStage struct {
+	dteEOL   byte
+	hostEOL  byte
+	pad      int
+	toDTECR  bool // The last byte to the DTE was a CR
+	toHostCR bool
+}
+
+// nil if there's nothing to do
+func newLineStage(dteEOL, hostEOL byte, pad int) stage {
+	if dteEOL == EOL_NONE && hostEOL == EOL_NONE && pad == 0 {
+		return nil
+	}
+	logger.Printf("Line ends: %s to DTE, %s to host, %d NULs after CR",
+		eolName(dteEOL), eolName(hostEOL), pad)
+	return &lineStage{dteEOL: dteEOL, hostEOL: hostEOL, pad: pad}
+}
+
+// Rewrite the line ends in p
+func convertEOL(p []byte, mode byte, sawCR *bool) []byte {
+	if mode == EOL_NONE {
+		return p
+	}
+
+	var out []byte
+	for _, c := range p {
+		prevCR := *sawCR
+		*sawCR = c == '\r'
+
+		switch {
+		case mode == EOL_STRIPLF && c == '\n':
+		case mode == EOL_STRIPLF:
+			out = append(out, c)
+		case c == '\n' && prevCR:
+			// The LF of a CRLF, already done
+		case c == '\r' || c == '\n':
+			switch mode {
+			case EOL_CR:
+				out = append(out, '\r')
+			case EOL_LF:
+				out = append(out, '\n')
+			case EOL_CRLF:
+				out = append(out, '\r', '\n')
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (l *lineStage) ToDTE(p []byte) []byte {
+	p = convertEOL(p, l.dteEOL, &l.toDTECR)
+	if l.pad == 0 {
+		return p
+	}
+
+	var out []byte
+	for _, c := range p {
+		out = append(out, c)
+		if c == '\r' {
+			out = append(out, make([]byte, l.pad)...)
+		}
+	}
+	return out
+}
+
+func (l *lineStage) FromDTE(p []byte) []byte {
+	return convertEOL(p, l.hostEOL, &l.toHostCR)
+}
+
+// What to echo back to the DTE for c, if local echo is on.
+func localEcho(c byte) []byte {
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+
+	s := translation.settings
+	if !translation.active || !s.echo {
+		return nil
+	}
+	if c == registers.Read(REG_CR_CH) && s.dteEOL != EOL_CR {
+		return append([]byte{c, '\n'}, make([]byte, s.pad)...)
+	}
+	return []byte{c}
+}
+
+// AT*eol[=dte[,host]]
+func setLineEnds(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		names := strings.Split(cmd[i+1:], ",")
+		if len(names) > 2 {
+			return ERROR
+		}
+		regs := []int{REG_DTE_EOL, REG_HOST_EOL}
+		for n, name := range names {
+			e, ok := eolByName(name)
+			if !ok {
+				return ERROR
+			}
+			registers.Set(regs[n], int(e))
+		}
+	}
+
+	serial.Printf("LINE ENDS: DTE %s, HOST %s\n",
+		strings.ToUpper(eolName(registers.Read(REG_DTE_EOL))),
+		strings.ToUpper(eolName(registers.Read(REG_HOST_EOL))))
+	return OK
+}
+
+// AT*pad[=n]
+func setPadding(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		n, err := strconv.Atoi(cmd[i+1:])
+		if err != nil || registers.Set(REG_CR_PAD, n) != OK {
+			return ERROR
+		}
+	}
+	serial.Printf("CR PADDING: %d\n", registers.Read(REG_CR_PAD))
+	return OK
+}
+
+// AT*echo[=0|1]
+func setLocalEcho(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		switch cmd[i+1:] {
+		case "0":
+			registers.Set(REG_LOCAL_ECHO, 0)
+		case "1":
+			registers.Set(REG_LOCAL_ECHO, 1)
+		default:
+			return ERROR
+		}
+	}
+	if registers.Read(REG_LOCAL_ECHO) != 0 {
+		serial.Println("LOCAL ECHO: ON")
+	} else {
+		serial.Println("LOCAL ECHO: OFF")
+	}
+	return OK
+}
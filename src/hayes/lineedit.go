@@ -0,0 +1,268 @@
+package main
+
+// Command mode line editing, for dumb terminals: nothing is needed but
+// backspace.
+//
+//   BS (S5) or DEL    delete the last character
+//   Ctrl-U            delete the whole line
+//   Ctrl-W            delete the last word
+//   Ctrl-X            cancel the line
+//   Ctrl-P, Up        the previous command in the history
+//   Ctrl-N, Down      the next command in the history
+//
+// The history keeps the last __HISTORY_SIZE command lines, and can be
+// listed with AT*hist.  AT*hist=n puts command n on the next line to be
+// edited.  With -history, it's kept in a file across restarts.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const __HISTORY_SIZE = 20
+
+const (
+	__CTRL_N = 0x0e
+	__CTRL_P = 0x10
+	__CTRL_U = 0x15
+	__CTRL_W = 0x17
+	__CTRL_X = 0x18
+	__ESC    = 0x1b
+	__DEL    = 0x7f
+)
+
+type cmdHistory struct {
+	lock    sync.Mutex
+	lines   []string // Oldest first
+	file    string
+	preload string // From AT*hist=n, for the next line
+}
+
+var history cmdHistory
+
+// Load the history from file, if there is one
+func (h *cmdHistory) load(file string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.file = file
+	if file == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		logger.Printf("Can't read history file: %s", err)
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > __HISTORY_SIZE {
+		h.lines = h.lines[len(h.lines)-__HISTORY_SIZE:]
+	}
+}
+
+// Remember a command line, unless it's the same as the last one
+func (h *cmdHistory) add(line string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > __HISTORY_SIZE {
+		h.lines = h.lines[1:]
+	}
+
+	if h.file != "" {
+		// It can hold passwords (ATDE), so only we can read it
+		data := strings.Join(h.lines, "\n") + "\n"
+		if err := writeFileAtomic(h.file, []byte(data), 0600); err != nil {
+			logger.Printf("Can't write history file: %s", err)
+		}
+	}
+}
+
+func (h *cmdHistory) get() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.lines...)
+}
+
+// The line AT*hist=n asked for, once
+func (h *cmdHistory) takePreload() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.preload
+	h.preload = ""
+	return s
+}
+
+// AT*hist[=n]
+func showHistory(cmd string) error {
+	lines := history.get()
+	i := strings.IndexByte(cmd, '=')
+	if i == -1 {
+		for n, line := range lines {
+			serial.Printf("%2d: %s\n", n+1, line)
+		}
+		return OK
+	}
+
+	n, err := strconv.Atoi(cmd[i+1:])
+	if err != nil || n < 1 || n > len(lines) {
+		return ERROR
+	}
+	history.lock.Lock()
+	history.preload = lines[n-1]
+	history.lock.Unlock()
+	return OK
+}
+
+type lineEditor struct {
+	line   []byte
+	write  func(p []byte) // Echo to the DTE
+	browse int            // Where we are in the history, -1 if not in it
+	lines  []string       // The history, while browsing it
+	esc    int            // 0, or how much of ESC [ we've seen
+}
+
+func newLineEditor(write func(p []byte)) *lineEditor {
+	return &lineEditor{write: write, browse: -1}
+}
+
+// Remove the last n characters, from the line and the DTE's screen
+func (l *lineEditor) erase(n int) {
+	if n > len(l.line) {
+		n = len(l.line)
+	}
+	// One at a time: the console turns a write that starts with BS into
+	// a single erase
+	for i := 0; i < n; i++ {
+		l.write([]byte("\b \b"))
+	}
+	l.line = l.line[:len(l.line)-n]
+}
+
+// Replace the line with s
+func (l *lineEditor) replace(s string) {
+	l.erase(len(l.line))
+	l.line = append(l.line, s...)
+	if len(l.line) > 0 {
+		l.write(l.line)
+	}
+}
+
+// Ctrl-P (dir -1) and Ctrl-N (dir 1)
+func (l *lineEditor) recall(dir int) {
+	if l.browse == -1 {
+		l.lines = history.get()
+		l.browse = len(l.lines)
+	}
+	i := l.browse + dir
+	if i < 0 || i > len(l.lines) {
+		return
+	}
+	l.browse = i
+	if i == len(l.lines) {
+		l.replace("")
+	} else {
+		l.replace(l.lines[i])
+	}
+}
+
+// Start a new line, with s on it
+func (l *lineEditor) reset(s string) {
+	l.line = l.line[:0]
+	l.browse = -1
+	l.esc = 0
+	if s != "" {
+		l.replace(s)
+	}
+}
+
+// Is c the / of A/?
+func (l *lineEditor) repeat(c byte) bool {
+	if c == '/' && (string(l.line) == "A" || string(l.line) == "a") {
+		l.write([]byte{c})
+		l.reset("")
+		return true
+	}
+	return false
+}
+
+// Edit the line with c.  Returns the line, and true, when cr ends it.
+func (l *lineEditor) Feed(c, cr, bs byte) (string, bool) {
+	// ESC [ A and ESC [ B (or ESC O A...) are the arrow keys
+	switch {
+	case l.esc == 0 && c == __ESC:
+		l.esc = 1
+		return "", false
+	case l.esc == 1 && (c == '[' || c == 'O'):
+		l.esc = 2
+		return "", false
+	case l.esc == 2:
+		l.esc = 0
+		switch c {
+		case 'A':
+			l.recall(-1)
+		case 'B':
+			l.recall(1)
+		}
+		return "", false
+	case l.esc == 1:
+		l.esc = 0
+	}
+
+	switch {
+	case c == cr:
+		l.write([]byte{c})
+		s := string(l.line)
+		l.reset("")
+		if s == "" {
+			return "", false
+		}
+		history.add(s)
+		return s, true
+
+	case c == bs || c == __DEL:
+		l.erase(1)
+
+	case c == __CTRL_U:
+		l.erase(len(l.line))
+
+	case c == __CTRL_W:
+		n := len(l.line)
+		for n > 0 && l.line[n-1] == ' ' {
+			n--
+		}
+		for n > 0 && l.line[n-1] != ' ' {
+			n--
+		}
+		l.erase(len(l.line) - n)
+
+	case c == __CTRL_X:
+		l.write([]byte(fmt.Sprintf("^X%c%c", cr, registers.Read(REG_LF_CH))))
+		l.reset("")
+
+	case c == __CTRL_P:
+		l.recall(-1)
+
+	case c == __CTRL_N:
+		l.recall(1)
+
+	case c < ' ':
+		// Nothing else is part of a command line
+
+	default:
+		l.line = append(l.line, c)
+		l.write([]byte{c})
+	}
+	return "", false
+}
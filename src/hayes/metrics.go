@@ -0,0 +1,190 @@
+package main
+
+// Optional Prometheus metrics endpoint.  The text exposition format is
+// simple enough that we write it by hand rather than pull in the client
+// library.
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metrics struct {
+	lock      sync.Mutex
+	calls     map[string]uint64 // "direction,result" -> count
+	busy      map[string]uint64 // protocol -> count
+	bytesSent uint64            // Totals from finished calls
+	bytesRecv uint64
+	live      connection // The call in progress, until it's counted
+	rings     uint64
+	serialIn  uint64
+	serialOut uint64
+}
+
+// A call has finished; count it and its traffic.
+func countCall(r *callRecord) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if metrics.calls == nil {
+		metrics.calls = make(map[string]uint64)
+	}
+	metrics.calls[r.Direction+","+r.Result]++
+	metrics.bytesSent += r.BytesOut
+	metrics.bytesRecv += r.BytesIn
+	metrics.live = nil // It's in the totals now
+}
+
+// A call has connected (nil: it's over).  Its traffic is counted live
+// until countCall() adds it to the totals, so the totals never go down.
+func meterCall(conn connection) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.live = conn
+}
+
+// An incoming call was turned away because the line was busy.
+func countBusy(protocol string) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if metrics.busy == nil {
+		metrics.busy = make(map[string]uint64)
+	}
+	metrics.busy[protocol]++
+}
+
+func countRing() {
+	atomic.AddUint64(&metrics.rings, 1)
+}
+
+func countSerial(in, out int) {
+	if in > 0 {
+		atomic.AddUint64(&metrics.serialIn, uint64(in))
+	}
+	if out > 0 {
+		atomic.AddUint64(&metrics.serialOut, uint64(out))
+	}
+}
+
+func writeMetric(w *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func b2f(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func renderMetrics() string {
+	var w strings.Builder
+
+	metrics.lock.Lock()
+	var keys []string
+	for k := range metrics.calls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeMetric(&w, "hayes_calls_total", "counter",
+		"Calls by direction and result code.")
+	for _, k := range keys {
+		l := strings.SplitN(k, ",", 2)
+		fmt.Fprintf(&w, "hayes_calls_total{direction=%q,result=%q} %d\n",
+			l[0], l[1], metrics.calls[k])
+	}
+
+	keys = nil
+	for k := range metrics.busy {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeMetric(&w, "hayes_busy_rejections_total", "counter",
+		"Incoming calls rejected because the line was busy.")
+	for _, k := range keys {
+		fmt.Fprintf(&w, "hayes_busy_rejections_total{protocol=%q} %d\n",
+			k, metrics.busy[k])
+	}
+
+	// Include the call in progress
+	sent, recv := metrics.bytesSent, metrics.bytesRecv
+	if metrics.live != nil {
+		s, r := metrics.live.Stats()
+		sent += s
+		recv += r
+	}
+	metrics.lock.Unlock()
+
+	writeMetric(&w, "hayes_network_sent_bytes_total", "counter",
+		"Bytes sent to remote hosts.")
+	fmt.Fprintf(&w, "hayes_network_sent_bytes_total %d\n", sent)
+	writeMetric(&w, "hayes_network_received_bytes_total", "counter",
+		"Bytes received from remote hosts.")
+	fmt.Fprintf(&w, "hayes_network_received_bytes_total %d\n", recv)
+
+	writeMetric(&w, "hayes_serial_read_bytes_total", "counter",
+		"Bytes read from the DTE.")
+	fmt.Fprintf(&w, "hayes_serial_read_bytes_total %d\n",
+		atomic.LoadUint64(&metrics.serialIn))
+	writeMetric(&w, "hayes_serial_written_bytes_total", "counter",
+		"Bytes written to the DTE.")
+	fmt.Fprintf(&w, "hayes_serial_written_bytes_total %d\n",
+		atomic.LoadUint64(&metrics.serialOut))
+
+	writeMetric(&w, "hayes_rings_total", "counter",
+		"Rings signalled to the DTE.")
+	fmt.Fprintf(&w, "hayes_rings_total %d\n",
+		atomic.LoadUint64(&metrics.rings))
+
+	writeMetric(&w, "hayes_data_mode", "gauge",
+		"1 if the modem is in data mode, 0 if in command mode.")
+	fmt.Fprintf(&w, "hayes_data_mode %d\n", b2f(m.getMode() == DATAMODE))
+
+	writeMetric(&w, "hayes_off_hook", "gauge",
+		"1 if the modem is off hook.")
+	fmt.Fprintf(&w, "hayes_off_hook %d\n", b2f(m.offHook()))
+
+	var offHook float64
+	if m.offHook() {
+		offHook = time.Since(m.getOffHookTime()).Seconds()
+	}
+	writeMetric(&w, "hayes_off_hook_seconds", "gauge",
+		"How long the modem has been off hook, 0 if on hook.")
+	fmt.Fprintf(&w, "hayes_off_hook_seconds %.3f\n", offHook)
+
+	writeMetric(&w, "hayes_carrier", "gauge",
+		"1 if there is carrier (an active connection).")
+	fmt.Fprintf(&w, "hayes_carrier %d\n", b2f(m.getdcd()))
+
+	writeMetric(&w, "hayes_line_busy", "gauge",
+		"1 if the line is busy.")
+	fmt.Fprintf(&w, "hayes_line_busy %d\n", b2f(m.getLineBusy()))
+
+	writeMetric(&w, "go_goroutines", "gauge",
+		"Number of goroutines that currently exist.")
+	fmt.Fprintf(&w, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	return w.String()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, renderMetrics())
+}
+
+// Serve /metrics on addr.
+// Must be a goroutine
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	logger.Printf("Listening: metrics http/%s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Printf("Metrics server failed: %s", err)
+	}
+}
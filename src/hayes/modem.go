@@ -23,10 +23,14 @@ type Modem struct {
 	lastDialed    string         // Last number dialed (for ATDL)
 	_connectSpeed int            // What speed did we connect at (0 or 38k)
 	_dcd          bool           // Data Carrier Detect -- active connection?
+	_carrierLost  bool           // The connection failed, see carrier.go
 	_lineBusy     bool           // Is the "phone line" busy?
 	_hook         bool           // Is the phone on or off hook?
 	_lastRingTime time.Time	     // When did the last ring occur? 
-	conn          connection     // Current active connection
+	_offHookTime  time.Time      // When did we go off hook?
+	_conn         connection     // Current active connection
+	entry         *pb_host       // Phonebook entry dialed, if any
+	_call         *callRecord    // Call detail record for this call
 }
 
 func (m *Modem) setMode(mode bool) {
@@ -74,9 +78,18 @@ func (m *Modem) goOnHook() {
 func (m *Modem) goOffHook() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	if m._hook != OFFHOOK {
+		m._offHookTime = time.Now()
+	}
 	m._hook = OFFHOOK
 }
 
+func (m *Modem) getOffHookTime() time.Time {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m._offHookTime
+}
+
 func (m *Modem) onHook() bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -107,6 +120,18 @@ func (m *Modem) getdcd() bool {
 	return m._dcd
 }
 
+func (m *Modem) setCarrierLost(lost bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m._carrierLost = lost
+}
+
+func (m *Modem) getCarrierLost() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m._carrierLost
+}
+
 func (m *Modem) setLastRingTime() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -120,7 +145,54 @@ func (m *Modem) getLastRingTime() time.Time {
 }
 
 func (m *Modem) resetLastRingTime() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m._lastRingTime = time.Time{}
+}
+
+func (m *Modem) setConn(conn connection) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m._conn = conn
+}
+
+func (m *Modem) getConn() connection {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	m._lastRingTime = time.Time{}
+	return m._conn
+}
+
+// Start the call detail record for a new call
+func (m *Modem) newCall(direction int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m._call = newCallRecord(direction)
+}
+
+// Fill in the call detail record, if there's a call.  f mustn't use m.
+func (m *Modem) updateCall(f func(r *callRecord)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m._call != nil {
+		f(m._call)
+	}
+}
+
+// A copy of the call detail record; false if there's no call
+func (m *Modem) getCall() (callRecord, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m._call == nil {
+		return callRecord{}, false
+	}
+	return *m._call, true
+}
+
+// The call's over; returns its record (nil if there wasn't one)
+func (m *Modem) takeCall() *callRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r := m._call
+	m._call = nil
+	return r
 }
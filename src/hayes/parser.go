@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -21,6 +22,34 @@ func parse(cmd string, opts string) (string, int, error) {
 	return "", 0, fmt.Errorf("Bad command: %s", cmd)
 }
 
+// Parse AT&W=name and ATZ=name.  The name is the rest of the command
+// line, and is kept in lower case.
+func parseProfileName(cmd string) (string, int, error) {
+	i := strings.IndexByte(cmd, '=')
+	name := strings.ToLower(strings.TrimSpace(cmd[i+1:]))
+	if name == "" {
+		return "", 0, fmt.Errorf("Bad command: %s", cmd)
+	}
+	return strings.ToUpper(cmd[:i]) + "=" + name, len(cmd), nil
+}
+
+// Parse ATIn, n 0 to __MAX_INFO
+func parseInfo(cmd string) (string, int, error) {
+	i := 1
+	for i < len(cmd) && i < 3 && cmd[i] >= '0' && cmd[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(cmd[1:i])
+	if i == 1 {
+		n, err = 0, nil
+	}
+	if err != nil || n > __MAX_INFO {
+		logger.Printf("Bad command: %s", cmd)
+		return "", 0, fmt.Errorf("Bad command: %s", cmd)
+	}
+	return fmt.Sprintf("I%d", n), i, nil
+}
+
 // Parse ATS...
 // Given a string that looks like a "S" command, parse & normalize it
 func parseRegisters(cmd string) (string, int, error) {
@@ -76,9 +105,14 @@ func parseAmpersand(cmdstr string) (string, int, error) {
 	// AT&R, AT&S, AT&T, AT&U, AT&X
 
 	switch c {
+	case 'W':
+		if strings.HasPrefix(cmdstr[2:], "=") { // Named profile
+			return parseProfileName(cmdstr)
+		}
+		opts = "01"
 	case 'F', 'V':
 		opts = "0"
-	case 'A', 'B', 'C', 'J', 'L', 'R', 'S', 'U', 'W', 'Y':
+	case 'A', 'B', 'C', 'J', 'L', 'R', 'S', 'U', 'Y':
 		opts = "01"
 	case 'G', 'X', 'P':
 		opts = "012"
@@ -91,25 +125,26 @@ func parseAmpersand(cmdstr string) (string, int, error) {
 	case 'T':
 		opts = "0123456789"
 	case 'Z':
-		var idx int
-		var str string
-		var err error
-
-		switch cmdstr[1] { // username/passwd could be case-sensitive
-		case 'Z':
-			_, err = fmt.Sscanf(cmdstr, "&Z%d=%s", &idx, &str)
-		case 'z':
-			_, err = fmt.Sscanf(cmdstr, "&z%d=%s", &idx, &str)
-		default:
-			err = fmt.Errorf("Badly formated &Z command: %s", cmdstr)
-		}
-
-		if err != nil {
+		// AT&Zn=number, with AT&Z=number for &Z0.  The number (or
+		// host entry) is the rest of the line, left as it is since
+		// username/passwd could be case-sensitive.
+		idx := 0
+		e := strings.IndexByte(cmdstr, '=')
+		if e == -1 {
+			err := fmt.Errorf("Badly formated &Z command: %s", cmdstr)
 			logger.Print("ERROR: ", err)
 			return "", 0, err
 		}
-		s := fmt.Sprintf("&Z%d=%s", idx, str)
-		return s, len(s), nil
+		if e > 2 {
+			n, err := strconv.Atoi(cmdstr[2:e])
+			if err != nil {
+				logger.Print("ERROR: ", err)
+				return "", 0, err
+			}
+			idx = n
+		}
+		s := fmt.Sprintf("&Z%d=%s", idx, cmdstr[e+1:])
+		return s, len(cmdstr), nil
 	default:
 		logger.Printf("Unknown &cmd: %s", cmdstr)
 		return "", 0, ERROR
@@ -164,6 +199,12 @@ func parseCommand(cmdstring string) ([]string, error) {
 	//   i: characters parsed out of cmdstring
 	// err: discrete command parse failed in some way.
 	for c < len(cmd) && status == OK {
+		if n := pers.faked(f[c:]); n > 0 { // Personality's faked commands
+			commands = append(commands, f[c:c+n])
+			c += n
+			continue
+		}
+
 		switch f[c] {
 		case 'P', 'T':
 			s = f[c:1]
@@ -175,12 +216,21 @@ func parseCommand(cmdstring string) ([]string, error) {
 			s, i, err = parseRegisters(cmd[c:])
 		case '*': // Custom debug registers
 			s, i, err = parseDebug(cmd[c:])
+		case '+': // V.250 extended commands
+			s, i, err = parseExtended(cmd[c:])
 		case '&':
 			s, i, err = parseAmpersand(cmd[c:])
 		case 'A':
 			opts = "0"
 			s, i, err = parse(cmd[c:], opts)
-		case 'E', 'H', 'Q', 'V', 'Z':
+		case 'Z':
+			if strings.HasPrefix(cmd[c+1:], "=") { // Named profile
+				s, i, err = parseProfileName(cmd[c:])
+				break
+			}
+			opts = "01"
+			s, i, err = parse(cmd[c:], opts)
+		case 'E', 'H', 'Q', 'V':
 			opts = "01"
 			s, i, err = parse(cmd[c:], opts)
 		case 'M', 'W':
@@ -193,11 +243,10 @@ func parseCommand(cmdstring string) ([]string, error) {
 			opts = "O"
 			s, i, err = parse(cmd[c:], opts)
 		case 'X':
-			opts = "01234567"
+			opts = "01234"
 			s, i, err = parse(cmd[c:], opts)
 		case 'I':
-			opts = "012345"
-			s, i, err = parse(cmd[c:], opts)
+			s, i, err = parseInfo(cmd[c:])
 
 		// faked out commands
 		case 'Y', 'C':
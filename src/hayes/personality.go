@@ -0,0 +1,334 @@
+package main
+
+// Modem personalities: what the modem says it is.  A personality has the
+// ATI0-ATI11 text, the result codes, the settings line of AT&V, the
+// default S-registers and any extra commands that should just answer OK,
+// so software that looks for a particular modem finds it.
+//
+// Hayes, USR Courier and generic V.34 personalities are built in; more can
+// be added as JSON files (one personality each, see
+// docs/personalities/zoom.json) in the -personalities directory.  A file
+// with the same name as a built in personality replaces it.  -personality
+// or AT*personality=name picks one.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	__PERSONALITY_DIR = "./personalities"
+	__PERSONALITY     = "hayes"
+	__MAX_INFO        = 11 // ATI11
+)
+
+type resultCode struct {
+	Code byte   `json:"Code"`
+	Text string `json:"Text"`
+}
+
+type personality struct {
+	Name         string          `json:"Name"`
+	Manufacturer string          `json:"Manufacturer"` // +GMI
+	Model        string          `json:"Model"`        // +GMM
+	Revision     string          `json:"Revision"`     // +GMR
+	Info         map[int]string  `json:"Info"`         // ATIn
+	Profile      string          `json:"Profile"`      // AT&V settings
+	Regs         map[string]byte `json:"Regs"`         // Default registers
+
+	// Replacements for the Hayes result codes, by their Hayes text
+	// ("NO DIALTONE", "CONNECT 9600"...)
+	Results map[string]resultCode `json:"Results"`
+
+	// Commands that answer OK and do nothing ("&H", "%C"...); any digits
+	// after them are part of the command.
+	Faked []string `json:"Faked"`
+
+	profile *template.Template
+}
+
+// The Hayes AT&V settings line
+const __HAYES_PROFILE = "B16 B1 B41 B60 E{{b .EchoInCmdMode}}F1 " +
+	"L{{.SpeakerVolume}} M{{.SpeakerMode}} N1 Q{{b .Quiet}}" +
+	"V{{b .Verbose}}W{{.Negotiation}} X{{.ResultLevel}} Y0 &A0 " +
+	"&C{{b .DCDPinned}}&D{{.DTR}} &G0 &J0 &K0 &Q{{.ErrorControl}} &R0 " +
+	"&S{{b .DSRPinned}}&T4 &U0 &X4 "
+
+var builtinPersonalities = []personality{
+	{
+		Name:         "hayes",
+		Manufacturer: "Hayes Microcomputer Products",
+		Model:        "Smartmodem Ultra 96",
+		Revision:     "04-00472-3143", // ROM part number, as in ATI3
+		Info: map[int]string{
+			0: "14400",
+			1: "058", // From my Hayes Ultra 96
+			2: "OK\n",
+			3: "04-0045012 240 PASS\n\n" +
+				"04-00471-3143 080 PASS\n\n" +
+				"04-00472-3143 190 PASS\n",
+			4: "a097841F284C6403F00000090\n\n" +
+				"bF60437000\n\n" +
+				"r1031111111010000\n\n" +
+				"r3000111010000000\n",
+			5: "004\na 001 001 003 PASS",
+		},
+		Profile: __HAYES_PROFILE,
+	},
+	{
+		Name:         "usr",
+		Manufacturer: "U.S. Robotics",
+		Model:        "Courier V.Everything",
+		Revision:     "Supervisor 6.5.3",
+		Info: map[int]string{
+			0: "3361",
+			1: "A9F2",
+			2: "OK",
+			3: "U.S. Robotics Courier V.Everything Rev. 6.5.3",
+			6: "U.S. Robotics Courier V.Everything Link Diagnostics...\n\n" +
+				"No Link Diagnostics Available",
+			7: "Configuration Profile...\n\n" +
+				"Product type           US/Canada External\n" +
+				"Options                HST,V32bis,Terbo,VFC,V34+\n" +
+				"Fax Options            Class 1/Class 2.0\n" +
+				"Clock Freq             25.0Mhz\n" +
+				"EPROM                  256k\n" +
+				"RAM                    64k\n\n" +
+				"Supervisor date        05/15/96\n" +
+				"DSP date               05/15/96",
+		},
+		Profile: "U.S. Robotics Courier V.Everything Settings...\n\n" +
+			"B0 C1 E{{b .EchoInCmdMode}}F1 M{{.SpeakerMode}} " +
+			"Q{{b .Quiet}}V{{b .Verbose}}X{{.ResultLevel}} " +
+			"&A3 &B1 &C{{b .DCDPinned}}&D{{.DTR}} &G0 &H1 &I0 &K1 &M4 " +
+			"&N0 &P0 &R2 &S{{b .DSRPinned}}&T5 &U0 &X0 &Y1 %N6 ",
+		Regs: map[string]byte{
+			"7":  60,
+			"10": 7,
+			"11": 70,
+		},
+		Results: map[string]resultCode{
+			"NO DIALTONE":   {6, "NO DIAL TONE"},
+			"CONNECT 4800":  {18, "CONNECT 4800"},
+			"CONNECT 7200":  {20, "CONNECT 7200"},
+			"CONNECT 9600":  {13, "CONNECT 9600"},
+			"CONNECT 12000": {21, "CONNECT 12000"},
+			"CONNECT 14400": {25, "CONNECT 14400"},
+			"CONNECT 19200": {85, "CONNECT 19200"},
+		},
+		Faked: []string{"&H", "&I", "&N", "&Y", "%N"},
+	},
+	{
+		Name:         "v34",
+		Manufacturer: "Generic",
+		Model:        "V.34 Data/Fax Modem",
+		Revision:     "1.0",
+		Info: map[int]string{
+			0: "28800",
+			3: "V.34 Data/Fax Modem Version 1.0",
+		},
+		Profile: "E{{b .EchoInCmdMode}}L{{.SpeakerVolume}} " +
+			"M{{.SpeakerMode}} Q{{b .Quiet}}V{{b .Verbose}}" +
+			"W{{.Negotiation}} X{{.ResultLevel}} &C{{b .DCDPinned}}" +
+			"&D{{.DTR}} &K3 &Q{{.ErrorControl}} &S{{b .DSRPinned}}",
+		Regs: map[string]byte{
+			"7": 50,
+		},
+		Faked: []string{"%C", "\\N"},
+	},
+}
+
+var personalities map[string]*personality
+var pers *personality // The current one
+
+// Functions for Profile templates
+var profileFuncs = template.FuncMap{
+	"b": func(p bool) string {
+		if p {
+			return "1 "
+		}
+		return "0 "
+	},
+}
+
+func (p *personality) compile() error {
+	if p.Name == "" {
+		return fmt.Errorf("Personality has no name")
+	}
+	p.Name = strings.ToLower(p.Name)
+	if p.Profile == "" {
+		p.Profile = __HAYES_PROFILE
+	}
+	t, err := template.New(p.Name).Funcs(profileFuncs).Parse(p.Profile)
+	if err != nil {
+		return fmt.Errorf("Personality %s: %s", p.Name, err)
+	}
+	p.profile = t
+
+	// Checked as registersJsonUnmap does, so a bad one can't get past
+	// registers.Reset()
+	for key, val := range p.Regs {
+		n, err := strconv.Atoi(key)
+		var d *regDef
+		if err == nil {
+			d = registerDef(n)
+		}
+		switch {
+		case d == nil:
+			logger.Printf("Personality %s: bad register %s", p.Name, key)
+		case d.readOnly:
+			logger.Printf("Personality %s: S%d is read only", p.Name, n)
+		case !d.accepts(int(val)):
+			logger.Printf("Personality %s: bad value S%d = %d", p.Name,
+				n, val)
+		default:
+			continue
+		}
+		delete(p.Regs, key)
+	}
+	return nil
+}
+
+// Load the built in personalities, then any in dir
+func loadPersonalities(dir string) {
+	personalities = make(map[string]*personality)
+	for i := range builtinPersonalities {
+		p := builtinPersonalities[i]
+		if err := p.compile(); err != nil {
+			logger.Print(err)
+			continue
+		}
+		personalities[p.Name] = &p
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	for _, f := range files {
+		var p personality
+		b, err := ioutil.ReadFile(f)
+		if err == nil {
+			err = json.Unmarshal(b, &p)
+		}
+		if err == nil {
+			err = p.compile()
+		}
+		if err != nil {
+			logger.Printf("Can't load personality %s: %s", f, err)
+			continue
+		}
+		logger.Printf("Loaded personality %s from %s", p.Name, f)
+		personalities[p.Name] = &p
+	}
+}
+
+func setPersonality(name string) error {
+	p, ok := personalities[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Unknown personality '%s'", name)
+	}
+	logger.Printf("Personality: %s", p.Name)
+	pers = p
+	return nil
+}
+
+// The settings line of AT&V for c
+func (p *personality) profileLine(c configtype) string {
+	var b strings.Builder
+	if err := p.profile.Execute(&b, c); err != nil {
+		logger.Printf("Personality %s: %s", p.Name, err)
+	}
+
+	// Wrap each line the template asked for separately
+	lines := strings.Split(b.String(), "\n")
+	for i := range lines {
+		lines[i] = lineWrap(lines[i], 80)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The code and text for result e (nil is OK)
+func (p *personality) result(e *MError) (byte, string) {
+	code, text := byte(0), "OK"
+	if e != nil {
+		code, text = e.code, e.text
+	}
+	key := strings.TrimRight(text, "\n")
+	if r, ok := p.Results[key]; ok {
+		code, text = r.Code, r.Text+text[len(key):]
+	}
+	return code, text
+}
+
+// How much of cmd, from the start, is a faked command?  0 if none.
+func (p *personality) faked(cmd string) int {
+	n := 0
+	for _, f := range p.Faked {
+		f = strings.ToUpper(f)
+		if len(f) > n && strings.HasPrefix(strings.ToUpper(cmd), f) {
+			n = len(f)
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	for n < len(cmd) && cmd[n] >= '0' && cmd[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// The registers' defaults in this personality
+func (p *personality) resetRegisters(r *Registers) {
+	for key, val := range p.Regs {
+		n, _ := strconv.Atoi(key) // compile() checked them
+		r.Write(n, val)
+	}
+}
+
+// ATIn
+func identify(n int) error {
+	if n > __MAX_INFO {
+		return ERROR
+	}
+	if s, ok := pers.Info[n]; ok {
+		serial.Println(s)
+	}
+	return OK
+}
+
+// AT*personality[=name]
+func choosePersonality(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		if err := setPersonality(cmd[i+1:]); err != nil {
+			logger.Print(err)
+			return ERROR
+		}
+		registers.Reset()
+	}
+
+	var names []string
+	for name := range personalities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := personalities[name]
+		mark := " "
+		if p == pers {
+			mark = "*"
+		}
+		serial.Printf("%s %-10s %s %s\n", mark, p.Name, p.Manufacturer,
+			p.Model)
+	}
+	return OK
+}
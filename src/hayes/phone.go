@@ -15,10 +15,6 @@ const (
 // How many rings before giving up
 const __MAX_RINGS = 10
 
-// How long to wait for the remote to answer.  6 seconds is the default
-// ring-silence time
-const __CONNECT_TIMEOUT = __MAX_RINGS * 6 * time.Second
-
 // ATH0
 func hangup() error {
 	var ret error = OK
@@ -29,13 +25,15 @@ func hangup() error {
 
 	// It's OK to hang up the phone when there's no active network connection.
 	// But if there is, close it.
-	if m.conn != nil {
+	if conn := m.getConn(); conn != nil {
 		logger.Printf("Hanging up on active connection (remote %s)",
-			m.conn.RemoteAddr())
-		m.conn.Close()
+			conn.RemoteAddr())
+		conn.Close()
 		ret = NO_CARRIER
 	}
 
+	m.entry = nil
+	m.resetLastRingTime() // The call's over, nothing's ringing
 	m.setMode(COMMANDMODE)
 	m.setConnectSpeed(0)
 	m.setLineBusy(false)
@@ -101,6 +99,7 @@ func answerIncomming(conn connection) bool {
 		// "RING" text /after/ the RI signal is lowered.  Do
 		// this here so we behave the same.
 		serial.Println(RING)
+		countRing()
 		lcd.Printf(1, "RING %2d", i)
 		lcd.Printf(2, "<%s", conn.RemoteAddr())
 
@@ -141,6 +140,7 @@ no_answer:
 	logger.Print("No answer")
 	conn.Write([]byte("No answer, closing connection\n\r"))
 	lowerRI()
+	m.resetLastRingTime()
 	prstatus(NO_ANSWER)
 	return false
 
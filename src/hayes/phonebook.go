@@ -5,20 +5,89 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type Phonebook struct {
 	entries  map[int]pb_host
 	filename string
 	log      *log.Logger
+	lock     sync.RWMutex // The management API changes entries too
 }
 type pb_host struct {
-	Phone    string `json:"Phone"`
-	Host     string `json:"Host"`
-	Protocol string `json:"Protocol"`
-	Username string `json:"Username"`
-	Password string `json:"Password"`
+	Phone     string   `json:"Phone"`
+	Name      string   `json:"Name"`
+	Aliases   []string `json:"Aliases"`
+	Host      string   `json:"Host"`
+	Protocol  string   `json:"Protocol"`
+	Username  string   `json:"Username"`
+	Password  string   `json:"Password"`
+	Record    bool     `json:"Record"`    // Always record calls to this host
+	Reconnect bool     `json:"Reconnect"` // Redial if the network fails
+
+	// Translation, overriding the S-registers for calls to this host
+	Charset     string `json:"Charset"`     // The host's character set
+	DTECharset  string `json:"DTECharset"`  // The DTE's
+	Terminal    string `json:"Terminal"`    // The DTE's terminal type
+	Columns     int    `json:"Columns"`     // The DTE's screen size
+	Rows        int    `json:"Rows"`
+	DTELineEnd  string `json:"DTELineEnd"`  // none, cr, lf, crlf, striplf
+	HostLineEnd string `json:"HostLineEnd"`
+	CRPadding   int    `json:"CRPadding"`   // NULs after CR to the DTE
+	LocalEcho   bool   `json:"LocalEcho"`   // Echo what the DTE sends
+
+	// replay
+	Speed      float64 `json:"Speed"`      // Playback speed, 1 if unset
+	CheckInput bool    `json:"CheckInput"` // Compare DTE input to recording
+
+	// exec
+	Args []string `json:"Args"` // Arguments to the program in Host
+	Env  []string `json:"Env"`  // Extra KEY=value environment variables
+	Dir  string   `json:"Dir"`  // Working directory
+
+	// serial
+	Baud int `json:"Baud"` // Speed to open the device in Host at
+}
+
+// What to call this entry when showing it to the user; the name if it
+// has one, otherwise the host.
+func (h pb_host) displayName() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Host
+}
+
+// Does this entry's name or one of its aliases match name?  If prefix
+// is true, name need only be a prefix of the entry's name or alias.
+// Case is ignored.
+func (h pb_host) matchesName(name string, prefix bool) bool {
+	name = strings.ToUpper(name)
+	for _, n := range append([]string{h.Name}, h.Aliases...) {
+		if n == "" {
+			continue
+		}
+		n = strings.ToUpper(n)
+		if n == name || (prefix && strings.HasPrefix(n, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Are the entry's translation settings in range?  The phonebook file and
+// the API can set anything, the registers they override can't.
+func (h pb_host) checkTranslation() error {
+	if h.CRPadding < 0 || h.CRPadding > __MAX_CR_PAD {
+		return fmt.Errorf("Bad CRPadding %d (0-%d)", h.CRPadding,
+			__MAX_CR_PAD)
+	}
+	if !validTerminalSize(h.Columns) || !validTerminalSize(h.Rows) {
+		return fmt.Errorf("Bad screen size %dx%d", h.Columns, h.Rows)
+	}
+	return nil
 }
 
 func NewPhonebook(filename string, log *log.Logger) *Phonebook {
@@ -38,14 +107,23 @@ func (p *Phonebook) Load() error {
 		return e
 	}
 
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if err = json.Unmarshal(b, &p.entries); err != nil {
 		p.log.Print(err)
 		return err
 	}
+	for i, h := range p.entries {
+		if err := h.checkTranslation(); err != nil {
+			p.log.Printf("Ignoring phonebook entry %d: %s", i, err)
+			delete(p.entries, i)
+		}
+	}
 
 	return nil
 }
 
+// Must be called with p.lock held
 func (p *Phonebook) Write() error {
 	b, err := json.MarshalIndent(p.entries, "", "\t")
 	if err != nil {
@@ -62,6 +140,9 @@ func (p *Phonebook) Write() error {
 func (p *Phonebook) String() string {
 	var s string
 
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
 	count := len(p.entries)
 	if count  == 0 {
 		return "0=\n1=\n2=\n3=\n"
@@ -78,7 +159,8 @@ func (p *Phonebook) String() string {
 				phone = entry.Phone
 			}
 			s += fmt.Sprintf("%d=%s (%s, '%s'/'%s')\n", i, phone,
-				entry.Host, entry.Username, entry.Password)
+				entry.displayName(), entry.Username,
+				entry.Password)
 		} else {
 			s += fmt.Sprintf("%d=\n", i)
 		}
@@ -123,26 +205,69 @@ func sanitizeNumber(n string) (string, error) {
 	return strings.Map(check, n), nil
 }
 
-func (p *Phonebook) Lookup(number string) (string, string, string, string, error) {
+func (p *Phonebook) Lookup(number string) (pb_host, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.lookup(number)
+}
+
+// Must be called with p.lock held
+func (p *Phonebook) lookup(number string) (pb_host, error) {
 	if !isValidPhoneNumber(number) {
-		return "", "", "", "",
-			fmt.Errorf("Invalid phone number '%s'", number)
+		return pb_host{}, fmt.Errorf("Invalid phone number '%s'", number)
 	}
 	sanitized_index, err := sanitizeNumber(number)
 	if err != nil {
-		return "", "", "", "", err
+		return pb_host{}, err
 	}
 	for _, h := range p.entries {
 		sanitized_n, _ := sanitizeNumber(h.Phone)
 		if sanitized_index == sanitized_n {
-			return h.Host, h.Protocol, h.Username, h.Password, nil
+			return h, nil
 		}
 	}
 	err = fmt.Errorf("Number '%s' not in phone book", number)
-	return "", "", "", "", err
+	return pb_host{}, err
+}
+
+// Find the entries whose name or alias matches name, ignoring case.
+// Exact matches win; if there are none, every entry the name is a
+// prefix of is returned.  More than one entry means the name is
+// ambiguous.
+func (p *Phonebook) LookupName(name string) []pb_host {
+	var exact, prefix []pb_host
+
+	if name == "" {
+		return nil
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var positions []int
+	for i := range p.entries {
+		positions = append(positions, i)
+	}
+	sort.Ints(positions)
+
+	for _, i := range positions {
+		h := p.entries[i]
+		switch {
+		case h.matchesName(name, false):
+			exact = append(exact, h)
+		case h.matchesName(name, true):
+			prefix = append(prefix, h)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return prefix
 }
 
 func (p *Phonebook) LookupStoredNumber(n int) (string, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	pb, ok := p.entries[n]
 	if !ok {
 		return "", fmt.Errorf("No entry at position %d", n)
@@ -150,44 +275,145 @@ func (p *Phonebook) LookupStoredNumber(n int) (string, error) {
 	return pb.Phone, nil
 }
 
-// Returns phone|host|protocol|username|password
-func splitAmperZ(cmd string) (string, string, string, string, string, error) {
+// Returns phone|host|protocol|username|password[|name]
+func splitAmperZ(cmd string) (string, string, string, string, string, string, error) {
 	s := strings.Split(cmd, "|")
-	if len(s) != 5 {
-		return "", "", "", "", "", fmt.Errorf("Malformated AT&Z command")
+	switch len(s) {
+	case 5:
+		return s[0], s[1], s[2], s[3], s[4], "", nil
+	case 6:
+		return s[0], s[1], s[2], s[3], s[4], s[5], nil
 	}
-	return s[0], s[1], s[2], s[3], s[4], nil
+	return "", "", "", "", "", "", fmt.Errorf("Malformated AT&Z command")
 }
 
 func (p *Phonebook) Add(pos int, phone string) error {
-	phone, host, proto, username, pw, err := splitAmperZ(phone)
+	phone, host, proto, username, pw, name, err := splitAmperZ(phone)
 	if err != nil {
 		return err
 	}
 
-	if !supportedProtocol(proto) {
-		return fmt.Errorf("Unsupported protocol '%s'", proto)
+	// AT&Z stores over whatever was at pos, as on a real modem
+	return p.add(pos, pb_host{
+		Phone:    phone,
+		Name:     name,
+		Host:     host,
+		Protocol: proto,
+		Username: username,
+		Password: pw,
+	}, true)
+}
+
+// Is everything the entry sets something we can use?
+func (h pb_host) check() error {
+	if !supportedProtocol(h.Protocol) {
+		return fmt.Errorf("Unsupported protocol '%s'", h.Protocol)
 	}
-	if !isValidPhoneNumber(phone) {
-		return fmt.Errorf("Invalid phone number '%s'", phone)
+	if !isValidPhoneNumber(h.Phone) {
+		return fmt.Errorf("Invalid phone number '%s'", h.Phone)
+	}
+	if err := h.checkTranslation(); err != nil {
+		return err
 	}
 
-	passed, _ := sanitizeNumber(phone)
+	found := func(_ byte, ok bool) bool { return ok }
+	byName := []struct {
+		field, name string
+		ok          bool
+	}{
+		{"Charset", h.Charset, found(charsetByName(h.Charset))},
+		{"DTECharset", h.DTECharset, found(charsetByName(h.DTECharset))},
+		{"Terminal", h.Terminal, found(terminalByName(h.Terminal))},
+		{"DTELineEnd", h.DTELineEnd, found(eolByName(h.DTELineEnd))},
+		{"HostLineEnd", h.HostLineEnd, found(eolByName(h.HostLineEnd))},
+	}
+	for _, n := range byName {
+		if n.name != "" && !n.ok {
+			return fmt.Errorf("Unknown %s '%s'", n.field, n.name)
+		}
+	}
+
+	switch strings.ToUpper(h.Protocol) {
+	case "REPLAY":
+		if h.Speed < 0 {
+			return fmt.Errorf("Bad Speed %g", h.Speed)
+		}
+	case "EXEC":
+		if h.Host == "" {
+			return fmt.Errorf("No program to run")
+		}
+		for _, e := range h.Env {
+			if !strings.Contains(e, "=") {
+				return fmt.Errorf("Bad Env '%s', not KEY=value", e)
+			}
+		}
+	case "SERIAL":
+		if h.Host == "" {
+			return fmt.Errorf("No serial device")
+		}
+		if h.Baud < 0 {
+			return fmt.Errorf("Bad Baud %d", h.Baud)
+		}
+	}
+	return nil
+}
+
+// Add an entry at an empty position
+func (p *Phonebook) AddEntry(pos int, h pb_host) error {
+	return p.add(pos, h, false)
+}
+
+func (p *Phonebook) add(pos int, h pb_host, replace bool) error {
+	if pos < 0 {
+		return fmt.Errorf("Bad position %d", pos)
+	}
+	if err := h.check(); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	passed, _ := sanitizeNumber(h.Phone)
 	inbook, _ := sanitizeNumber(p.entries[pos].Phone)
 	if inbook == passed {
 		return fmt.Errorf("Number alreasy exists at position %d in phonebook", pos)
 	}
+	if _, ok := p.entries[pos]; ok && !replace {
+		return fmt.Errorf("Position %d is already in use", pos)
+	}
 
-	if _, _, _, _, err = p.Lookup(phone); err == nil {
+	if _, err := p.lookup(h.Phone); err == nil {
 		return fmt.Errorf("Number already exisits at another position in phonebook")
 	}
 
-	p.entries[pos] = pb_host{phone, host, proto, username, pw}
+	if h.Name != "" {
+		for _, e := range p.entries {
+			if e.matchesName(h.Name, false) {
+				return fmt.Errorf("Name '%s' already exists in phonebook", h.Name)
+			}
+		}
+	}
+
+	p.entries[pos] = h
 	p.Write()
 	return nil
 }
 
+// A copy of the phonebook, by position
+func (p *Phonebook) Entries() map[int]pb_host {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	e := make(map[int]pb_host)
+	for i, h := range p.entries {
+		e[i] = h
+	}
+	return e
+}
+
 func (p *Phonebook) Delete(pos int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if _, ok := p.entries[pos]; ok {
 		delete(p.entries, pos)
 		return p.Write()
@@ -0,0 +1,285 @@
+package main
+
+// Record what goes over the line in data mode, with timestamps, as an
+// asciicast v2 file (https://docs.asciinema.org/manual/asciicast/v2/) or
+// a ttyrec file.  ttyrec has no way to say which direction data went, so
+// only what the remote sent the DTE is recorded in that format.
+//
+// asciicast is UTF-8, so what goes over the line is decoded from the
+// host's character set (S201, or the phonebook entry's "Charset") first.
+// With no host character set, bytes that aren't UTF-8 are taken as
+// Latin-1, so nothing is lost.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type recorder interface {
+	Output(p []byte) // Remote -> DTE
+	Input(p []byte)  // DTE -> remote
+	Close() error
+}
+
+var recording struct {
+	lock    sync.Mutex
+	enabled bool     // Record every call (-record, AT*record)
+	r       recorder // Recording of the active call, if any
+	toggled bool     // r was started by AT*record
+}
+
+// Implements recorder for asciicast v2 files
+type asciicastRecorder struct {
+	f     *os.File
+	start time.Time
+	out   codec // Remote -> DTE
+	in    codec // DTE -> remote, also in the host's character set
+}
+
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+func newAsciicastRecorder(filename, title string, charset byte) (*asciicastRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &asciicastRecorder{f: f, start: time.Now(),
+		out: recordingCodec(charset), in: recordingCodec(charset)}
+	h := asciicastHeader{2, 80, 24, r.start.Unix(), title}
+	b, err := json.Marshal(h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func recordingCodec(charset byte) codec {
+	if charset == CHARSET_NONE {
+		return &utf8Codec{latin1: true}
+	}
+	return newCodec(charset)
+}
+
+func (r *asciicastRecorder) write(kind string, text []rune) {
+	if len(text) == 0 {
+		return
+	}
+	t := time.Since(r.start).Seconds()
+	b, err := json.Marshal([]interface{}{t, kind, string(text)})
+	if err != nil {
+		logger.Printf("asciicast: %s", err)
+		return
+	}
+	if _, err = r.f.Write(append(b, '\n')); err != nil {
+		logger.Printf("asciicast: %s", err)
+	}
+}
+
+func (r *asciicastRecorder) Output(p []byte) {
+	r.write("o", r.out.decode(p))
+}
+
+func (r *asciicastRecorder) Input(p []byte) {
+	r.write("i", r.in.decode(p))
+}
+
+// Write out what's left of a partial UTF-8 sequence before closing
+func (r *asciicastRecorder) Close() error {
+	if u, ok := r.out.(*utf8Codec); ok {
+		r.write("o", u.flush())
+	}
+	if u, ok := r.in.(*utf8Codec); ok {
+		r.write("i", u.flush())
+	}
+	return r.f.Close()
+}
+
+// Implements recorder for ttyrec files
+type ttyrecRecorder struct {
+	f *os.File
+}
+
+func newTtyrecRecorder(filename string) (*ttyrecRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &ttyrecRecorder{f}, nil
+}
+
+// Each frame is seconds, microseconds and length as little endian 32 bit
+// integers, then the data.
+func (r *ttyrecRecorder) Output(p []byte) {
+	now := time.Now()
+	h := make([]byte, 12)
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(p)))
+	if _, err := r.f.Write(append(h, p...)); err != nil {
+		logger.Printf("ttyrec: %s", err)
+	}
+}
+
+func (r *ttyrecRecorder) Input(p []byte) {
+	// ttyrec only records output
+}
+
+func (r *ttyrecRecorder) Close() error {
+	return r.f.Close()
+}
+
+// Should the active call be recorded?
+func recordingWanted() bool {
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+	return recording.enabled || (m.entry != nil && m.entry.Record)
+}
+
+// Name the recording after the call: when it started and who it was with.
+func recordingName() string {
+	who := "call"
+	call, ok := m.getCall()
+	switch {
+	case m.entry != nil:
+		who = m.entry.displayName()
+	case ok && call.Number != "":
+		who = call.Number
+	case ok && call.Host != "":
+		who = call.Host
+	}
+
+	clean := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}
+	return time.Now().Format("20060102-150405") + "-" +
+		strings.Map(clean, who)
+}
+
+// Start recording the active call
+func startRecording() error {
+	var r recorder
+	var err error
+
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+
+	if recording.r != nil {
+		return nil
+	}
+
+	if err = os.MkdirAll(flags.recordDir, 0755); err != nil {
+		logger.Printf("Can't create recording directory: %s", err)
+		return err
+	}
+
+	name := filepath.Join(flags.recordDir, recordingName())
+	switch strings.ToLower(flags.recordFmt) {
+	case "ttyrec":
+		name += ".ttyrec"
+		r, err = newTtyrecRecorder(name)
+	default:
+		name += ".cast"
+		s := registerSettings()
+		s.applyEntry(m.entry)
+		r, err = newAsciicastRecorder(name, describeConnection(),
+			s.hostCharset)
+	}
+	if err != nil {
+		logger.Printf("Can't start recording: %s", err)
+		return err
+	}
+
+	logger.Printf("Recording call to %s", name)
+	recording.r = r
+	return nil
+}
+
+// Stop recording the active call, if it's being recorded
+func stopRecording() {
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+
+	if recording.r == nil {
+		return
+	}
+	if err := recording.r.Close(); err != nil {
+		logger.Printf("Closing recording: %s", err)
+	}
+	logger.Print("Recording stopped")
+	recording.r = nil
+	recording.toggled = false
+}
+
+func recordOutput(p []byte) {
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+	if recording.r != nil {
+		recording.r.Output(p)
+	}
+}
+
+func recordInput(p []byte) {
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+	if recording.r != nil {
+		recording.r.Input(p)
+	}
+}
+
+// AT*record - toggle recording of this and future calls
+func toggleRecording() error {
+	recording.lock.Lock()
+	recording.enabled = !recording.enabled
+	enabled := recording.enabled
+	recording.lock.Unlock()
+
+	switch {
+	case enabled && m.getConn() != nil:
+		recording.lock.Lock()
+		started := recording.r == nil
+		recording.lock.Unlock()
+		if err := startRecording(); err != nil {
+			return ERROR
+		}
+		recording.lock.Lock()
+		recording.toggled = started
+		recording.lock.Unlock()
+	case !enabled:
+		// Leave recordings that -record or the phonebook asked for
+		recording.lock.Lock()
+		toggled := recording.toggled
+		recording.lock.Unlock()
+		if toggled {
+			stopRecording()
+		}
+	}
+
+	if enabled {
+		serial.Println("RECORDING ON")
+	} else {
+		serial.Println("RECORDING OFF")
+	}
+	return OK
+}
@@ -0,0 +1,214 @@
+package main
+
+// Word wrap text from the host to the DTE's screen width (S203, or the
+// phonebook entry's "Columns"), for 40 and 64 column machines.  Text is
+// sent on as it arrives; when a word runs past the right margin it's
+// erased with backspaces and moved to the next line.  Escape sequences
+// pass through untouched and take up no room.
+//
+// The screen size (S203 columns, S204 rows) is also what SSH and exec
+// calls ask their pseudo-terminals to be.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Screen size when S203 or S204 are 0
+const (
+	__TERM_COLS = 80
+	__TERM_ROWS = 24
+)
+
+// Implements stage for word wrapping
+type reflowStage struct {
+	width    int
+	col      int
+	word     []byte // The word being written, escape sequences and all
+	wordCols int
+	utf8     bool
+	esc      int // Escape sequence state, as in ansiStage
+}
+
+// nil if there's nothing to do
+func newReflowStage(cols int, utf8 bool) stage {
+	if cols == 0 {
+		return nil
+	}
+	logger.Printf("Reflowing text to %d columns", cols)
+	return &reflowStage{width: cols, utf8: utf8}
+}
+
+func (r *reflowStage) FromDTE(p []byte) []byte {
+	return p
+}
+
+func (r *reflowStage) ToDTE(p []byte) []byte {
+	var out []byte
+	for _, c := range p {
+		out = r.feed(out, c)
+	}
+	return out
+}
+
+func (r *reflowStage) newLine(out []byte) []byte {
+	r.col = 0
+	r.word = r.word[:0]
+	r.wordCols = 0
+	return append(out, '\r', '\n')
+}
+
+func (r *reflowStage) feed(out []byte, c byte) []byte {
+	// Escape sequences go straight through, but are kept with the word
+	// in case it has to be moved.
+	if r.esc != ST_TEXT || c == 0x1b {
+		r.word = append(r.word, c)
+		switch {
+		case c == 0x1b:
+			r.esc = ST_ESC
+		case r.esc == ST_ESC && c == '[':
+			r.esc = ST_CSI
+		case r.esc == ST_ESC && (c == ']' || c == 'P'):
+			r.esc = ST_STRING
+		case r.esc == ST_ESC && c >= 0x20 && c <= 0x2f:
+			r.esc = ST_ESC_INTER
+		case r.esc == ST_ESC:
+			r.esc = ST_TEXT
+		case r.esc == ST_ESC_INTER && c >= 0x30:
+			r.esc = ST_TEXT
+		case r.esc == ST_CSI && c >= 0x40 && c <= 0x7e:
+			r.esc = ST_TEXT
+		case r.esc == ST_STRING && c == 0x07:
+			r.esc = ST_TEXT
+		case r.esc == ST_STRING && c == 0x1b:
+			r.esc = ST_STRING_ESC
+		case r.esc == ST_STRING_ESC:
+			r.esc = ST_STRING
+			if c == '\\' {
+				r.esc = ST_TEXT
+			}
+		}
+		if len(r.word) > __MAX_ESC_SEQ*4 { // Runaway
+			r.esc = ST_TEXT
+		}
+		return append(out, c)
+	}
+
+	switch {
+	case c == '\r':
+		r.col = 0
+		r.word = r.word[:0]
+		r.wordCols = 0
+
+	case c == '\n':
+		r.word = r.word[:0]
+		r.wordCols = 0
+
+	case c == '\b':
+		if r.col > 0 {
+			r.col--
+		}
+		if r.wordCols > 0 {
+			r.wordCols--
+		}
+
+	case c == '\t':
+		col := (r.col/8 + 1) * 8
+		if col >= r.width {
+			return r.newLine(out)
+		}
+		r.col = col
+		r.word = r.word[:0]
+		r.wordCols = 0
+
+	case c == ' ':
+		if r.col+1 > r.width {
+			return r.newLine(out) // Wrap here, dropping the space
+		}
+		r.col++
+		r.word = r.word[:0]
+		r.wordCols = 0
+
+	case c < 0x20 || c == 0x7f:
+		// Other control characters take no room
+
+	case r.utf8 && c&0xc0 == 0x80:
+		// UTF-8 continuation byte, part of the last character
+		r.word = append(r.word, c)
+
+	default:
+		if r.col+1 > r.width {
+			if r.wordCols > 0 && r.wordCols < r.width {
+				// Take the word back and start it on a new line
+				for i := 0; i < r.wordCols; i++ {
+					out = append(out, '\b', ' ', '\b')
+				}
+				word, cols := append([]byte{}, r.word...), r.wordCols
+				out = r.newLine(out)
+				out = append(out, word...)
+				r.word = append(r.word, word...)
+				r.col, r.wordCols = cols, cols
+			} else {
+				out = r.newLine(out)
+			}
+		}
+		r.col++
+		r.word = append(r.word, c)
+		r.wordCols++
+	}
+	return append(out, c)
+}
+
+// The screen size for a call: S203 and S204, or the phonebook entry's.
+func terminalSize(e *pb_host) (cols, rows int) {
+	cols = int(registers.Read(REG_COLUMNS))
+	rows = int(registers.Read(REG_ROWS))
+	if e != nil && e.checkTranslation() == nil {
+		if e.Columns != 0 {
+			cols = e.Columns
+		}
+		if e.Rows != 0 {
+			rows = e.Rows
+		}
+	}
+	if cols == 0 {
+		cols = __TERM_COLS
+	}
+	if rows == 0 {
+		rows = __TERM_ROWS
+	}
+	return cols, rows
+}
+
+// AT*size[=<cols>x<rows>]
+func setTerminalSize(cmd string) error {
+	i := strings.IndexByte(cmd, '=')
+	if i != -1 {
+		s := strings.SplitN(cmd[i+1:], "x", 2)
+		if len(s) != 2 {
+			return ERROR
+		}
+		cols, err1 := strconv.Atoi(s[0])
+		rows, err2 := strconv.Atoi(s[1])
+		if err1 != nil || err2 != nil || !validTerminalSize(cols) ||
+			!validTerminalSize(rows) {
+			return ERROR
+		}
+		registers.Set(REG_COLUMNS, cols)
+		registers.Set(REG_ROWS, rows)
+	}
+
+	cols, rows := terminalSize(nil)
+	if registers.Read(REG_COLUMNS) == 0 {
+		serial.Printf("SIZE: %dx%d (NO REFLOW)\n", cols, rows)
+	} else {
+		serial.Printf("SIZE: %dx%d\n", cols, rows)
+	}
+	return OK
+}
+
+// 0 means the default; anything else smaller than a TRS-80 Model I's
+// 16 rows is a mistake.
+func validTerminalSize(n int) bool {
+	return n == 0 || (n >= 16 && n <= 255)
+}
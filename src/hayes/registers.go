@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"sort"
 	"strconv"
 	"sync"
 )
@@ -72,47 +71,189 @@ const (
 	// If no data transfered in INACTIVITY_TIMER seconds, hangup
 	// and return to command mode.  Default is 0, disabled.
 	REG_INACTIVITY_TIMER = 30
+
+	// Extensions, not Hayes.
+
+	// The DTE's and remote host's character sets, see charset.go.
+	// Default 0 (no translation) and 2 (UTF-8).
+	REG_DTE_CHARSET = 200
+	REG_HOST_CHARSET = 201
+
+	// The DTE's terminal, for downgrading ANSI escape sequences, see
+	// ansi.go.  Default 0 (ANSI, no downgrading).
+	REG_TERMINAL = 202
+
+	// The DTE's screen size, for reflowing text and sizing SSH and
+	// exec pseudo-terminals, see reflow.go.  Default 0 (80 columns,
+	// no reflowing, and 24 rows).
+	REG_COLUMNS = 203
+	REG_ROWS = 204
+
+	// Data mode line discipline, see linedisc.go.  Line ends to the DTE
+	// and to the host, NULs after CR, and local echo.  Default 0 (off).
+	REG_DTE_EOL = 205
+	REG_HOST_EOL = 206
+	REG_CR_PAD = 207
+	REG_LOCAL_ECHO = 208
+
+	// How +++ escapes to command mode, see escape.go.  Default 0
+	// (Hayes guard times), or 1 (TIES).
+	REG_ESCAPE_MODE = 209
 )
 
 const __NUM_REGS = 256
 
+// What we know about a register.  Registers not in the table can't be
+// read or set by the DTE.
+type regDef struct {
+	reg      int
+	name     string
+	def      byte // Factory default
+	min, max int
+	readOnly bool
+	units    string
+	help     string
+	valid    func(val int) bool // Further checks, past min and max
+	hook     func(val byte)     // Called after ATSn= changes the register
+}
+
+var registerTable = []regDef{
+	{reg: REG_AUTO_ANSWER, name: "Auto answer", min: 0, max: 255,
+		units: "rings", help: "Answer after this many rings, 0 never",
+		hook: func(val byte) {
+			if val == 0 {
+				led_AA_off()
+			} else {
+				led_AA_on()
+			}
+		}},
+	{reg: REG_RING_COUNT, name: "Ring count", min: 0, max: 255,
+		readOnly: true, units: "rings", help: "Rings so far"},
+	{reg: REG_ESC_CH, name: "Escape character", def: '+', min: 0,
+		max: 255, units: "ASCII",
+		help: "Repeated 3 times to escape to command mode, >127 never"},
+	{reg: REG_CR_CH, name: "Carriage return character", def: '\r', min: 0,
+		max: 127, units: "ASCII", help: "Ends command lines"},
+	{reg: REG_LF_CH, name: "Line feed character", def: '\n', min: 0,
+		max: 127, units: "ASCII", help: "Sent after CR in result codes"},
+	{reg: REG_BS_CH, name: "Backspace character", def: '\b', min: 0,
+		max: 127, units: "ASCII", help: "Edits command lines"},
+	{reg: REG_BLIND_DIAL_WAIT, name: "Blind dial wait", def: 2, min: 2,
+		max: 255, units: "s", help: "Wait after going off hook before dialing"},
+	{reg: REG_WAIT_FOR_CARRIER_AFTER_DIAL, name: "Wait for carrier",
+		def: 50, min: 1, max: 255, units: "s",
+		help: "Wait for the remote to answer"},
+	{reg: REG_COMMA_DELAY, name: "Comma pause", def: 2, min: 0, max: 65,
+		units: "s", help: "Pause for each ',' in a dial string"},
+	{reg: REG_CARRIER_DETECT_RESPONSE_TIME, name: "Carrier detect time",
+		def: 6, min: 1, max: 255, units: "0.1s",
+		help: "Carrier must be present this long to be detected"},
+	{reg: REG_DELAY_BETWEEN_LOST_CARRIER_AND_HANGUP,
+		name: "Lost carrier delay", def: 14, min: 1, max: 255,
+		units: "0.1s", help: "Wait after losing carrier before hanging up"},
+	{reg: REG_MULTIFREQ_TONE_DURATION, name: "DTMF tone duration",
+		def: 95, min: 50, max: 255, units: "ms",
+		help: "Length of, and gap between, dialed tones"},
+	{reg: REG_ESC_CODE_GUARD_TIME, name: "Escape guard time", def: 50,
+		min: 0, max: 255, units: "0.02s",
+		help: "Quiet needed before and after the escape sequence"},
+	{reg: 18, name: "Test timer", min: 0, max: 255, units: "s",
+		help: "Not used"},
+	{reg: REG_DTR_DETECTION_TIME, name: "DTR detect time", def: 5, min: 0,
+		max: 255, units: "0.01s", help: "DTR must drop this long to count"},
+	{reg: 26, name: "RTS to CTS delay", def: 1, min: 0, max: 255,
+		units: "0.01s", help: "Not used"},
+	{reg: REG_INACTIVITY_TIMER, name: "Inactivity timer", min: 0, max: 255,
+		units: "10s", help: "Hang up after this long without data, 0 never"},
+	{reg: 36, name: "Negotiation fallback", def: 7, min: 0, max: 7,
+		help: "Not used"},
+	{reg: 37, name: "Line speed", min: 0, max: 255, help: "Not used"},
+	{reg: 38, name: "Forced hang up delay", def: 20, min: 0, max: 255,
+		units: "s", help: "Not used"},
+	{reg: 44, name: "Data link", def: 3, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 46, name: "Error control", def: 2, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 48, name: "Feature negotiation", def: 7, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 49, name: "Buffer low limit", def: 8, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 50, name: "Buffer high limit", def: 16, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 97, name: "V.32 handshake time", def: 30, min: 0, max: 255,
+		units: "0.1s", help: "Not used"},
+	{reg: 108, name: "Signal quality", def: 2, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 109, name: "Carrier speed", def: 62, min: 0, max: 255,
+		help: "Not used"},
+	{reg: 110, name: "V.32/V.32bis", def: 2, min: 0, max: 255,
+		help: "Not used"},
+
+	// Extensions
+	{reg: REG_DTE_CHARSET, name: "DTE character set", def: CHARSET_NONE,
+		min: 0, max: len(charsetNames) - 1,
+		help: "0 none 1 ascii 2 utf8 3 cp437 4 petscii 5 atascii",
+		hook: translationHook(REG_DTE_CHARSET)},
+	{reg: REG_HOST_CHARSET, name: "Host character set", def: CHARSET_UTF8,
+		min: 0, max: len(charsetNames) - 1, help: "As S200",
+		hook: translationHook(REG_HOST_CHARSET)},
+	{reg: REG_TERMINAL, name: "Terminal type", def: TERM_ANSI, min: 0,
+		max: len(terminalNames) - 1,
+		help: "0 ansi 1 strip 2 vt52 3 adm3a 4 dumb",
+		hook: translationHook(REG_TERMINAL)},
+	{reg: REG_COLUMNS, name: "Screen columns", min: 0, max: 255,
+		valid: validTerminalSize, help: "0 for 80 and no reflowing",
+		hook: translationHook(REG_COLUMNS)},
+	{reg: REG_ROWS, name: "Screen rows", min: 0, max: 255,
+		valid: validTerminalSize, help: "0 for 24",
+		hook: translationHook(REG_ROWS)},
+	{reg: REG_DTE_EOL, name: "Line ends to DTE", def: EOL_NONE, min: 0,
+		max: len(eolNames) - 1, help: "0 none 1 cr 2 lf 3 crlf 4 striplf",
+		hook: translationHook(REG_DTE_EOL)},
+	{reg: REG_HOST_EOL, name: "Line ends to host", def: EOL_NONE, min: 0,
+		max: len(eolNames) - 1, help: "As S205",
+		hook: translationHook(REG_HOST_EOL)},
+	{reg: REG_CR_PAD, name: "CR padding", min: 0, max: __MAX_CR_PAD,
+		units: "NULs", help: "Sent to the DTE after each CR",
+		hook: translationHook(REG_CR_PAD)},
+	{reg: REG_LOCAL_ECHO, name: "Local echo", min: 0, max: 1,
+		help: "Echo the DTE in data mode",
+		hook: translationHook(REG_LOCAL_ECHO)},
+	{reg: REG_ESCAPE_MODE, name: "Escape mode", def: ESCAPE_HAYES, min: 0,
+		max: len(escapeModeNames) - 1,
+		help: "0 hayes (guard times) 1 ties (+++AT<cmd><CR>)"},
+}
+
+// The table, by register number
+var registerDefs = func() (d [__NUM_REGS]*regDef) {
+	for i := range registerTable {
+		d[registerTable[i].reg] = &registerTable[i]
+	}
+	return d
+}()
+
+func translationHook(reg int) func(byte) {
+	return func(val byte) {
+		updateTranslation(reg, val)
+	}
+}
+
+func registerDef(regnum int) *regDef {
+	if regnum < 0 || regnum >= __NUM_REGS {
+		return nil
+	}
+	return registerDefs[regnum]
+}
+
 // Setup register defaults for the modem
 func (r *Registers) Reset() {
-
-	r.Write(REG_AUTO_ANSWER, 0)
-	r.Write(REG_RING_COUNT, 0)
-	r.Write(REG_ESC_CH, byte('+'))
-	r.Write(REG_CR_CH, byte('\r'))
-	r.Write(REG_LF_CH, byte('\n'))
-	r.Write(REG_BS_CH, byte('\b'))
-	r.Write(REG_BLIND_DIAL_WAIT, 2)
-	r.Write(REG_WAIT_FOR_CARRIER_AFTER_DIAL, 50)
-	r.Write(REG_COMMA_DELAY, 2)
-	r.Write(REG_CARRIER_DETECT_RESPONSE_TIME, 6)
-	r.Write(REG_DELAY_BETWEEN_LOST_CARRIER_AND_HANGUP, 14)
-	r.Write(REG_MULTIFREQ_TONE_DURATION, 95)
-	r.Write(REG_ESC_CODE_GUARD_TIME, 50)
-	r.Write(REG_DTR_DETECTION_TIME, 5)
-	r.Write(REG_INACTIVITY_TIMER, 0)
-
-	// These are cosmetic, not functional.
-	r.Write(18, 0)
-	r.Write(26, 1)
-	r.Write(36, 7)
-	r.Write(37, 0)
-	r.Write(38, 20)
-	r.Write(44, 3)
-	r.Write(46, 2)
-	r.Write(48, 7)
-	r.Write(49, 8)
-	r.Write(50, 16)
-	r.Write(97, 30)
-	r.Write(108, 2)
-	r.Write(109, 62)
-	r.Write(110, 2)
-}
-
-var escSequence [3]byte = [3]byte{'+', '+', '+'}
+	for _, d := range registerTable {
+		r.Write(d.reg, d.def)
+	}
+	if pers != nil {
+		pers.resetRegisters(r)
+	}
+}
 
 func NewRegisters() *Registers {
 	var r Registers
@@ -140,7 +281,7 @@ func (r *Registers) ReadCurrent() byte {
 
 // Note the locks here.
 func (r *Registers) SetCurrent(regnum int) error {
-	if regnum < 0 || regnum > __NUM_REGS {
+	if registerDef(regnum) == nil {
 		return fmt.Errorf("Invalid register numnber: %d", regnum)
 	}
 	r.rlock.Lock()
@@ -156,7 +297,7 @@ func (r *Registers) ShowCurrent() int {
 }
 
 func (r *Registers) Write(regnum int, val byte) error {
-	if regnum < 0 || regnum > __NUM_REGS {
+	if regnum < 0 || regnum >= __NUM_REGS {
 		return fmt.Errorf("Invalid register numnber: %d", regnum)
 	}
 	r.rlock.Lock()
@@ -167,7 +308,7 @@ func (r *Registers) Write(regnum int, val byte) error {
 }
 
 func (r *Registers) Read(regnum int) byte {
-	if regnum < 0 || regnum > __NUM_REGS {
+	if regnum < 0 || regnum >= __NUM_REGS {
 		panic("invalid read register")
 	}
 	r.rlock.RLock()
@@ -178,6 +319,25 @@ func (r *Registers) Read(regnum int) byte {
 	return 0
 }
 
+// Is val in range, and valid, for the register?
+func (d *regDef) accepts(val int) bool {
+	return val >= d.min && val <= d.max && (d.valid == nil || d.valid(val))
+}
+
+// Set a register for the DTE (ATSn=, AT* commands): check the value
+// against the table and run the register's hook.
+func (r *Registers) Set(regnum int, val int) error {
+	d := registerDef(regnum)
+	if d == nil || d.readOnly || !d.accepts(val) {
+		return ERROR
+	}
+	r.Write(regnum, byte(val))
+	if d.hook != nil {
+		d.hook(byte(val))
+	}
+	return OK
+}
+
 func (r *Registers) Inc(regnum int) byte {
 	r.rlock.Lock()
 	defer r.rlock.Unlock()
@@ -186,49 +346,68 @@ func (r *Registers) Inc(regnum int) byte {
 	return r.regs[regnum].val
 }
 
-func (r *Registers) activeRegisters() (i []int) {
-	r.rlock.RLock()
-	defer r.rlock.RUnlock()
-	for f := 0; f < __NUM_REGS; f++ {
-		if r.regs[f].valid {
-			i = append(i, f)
-		}
-	}
-	sort.Ints(i)
-	return i
-}
-
 func (r *Registers) String() string {
 	var s string
-	for _, f := range r.activeRegisters() {
-		s += fmt.Sprintf("S%02d:%03d ", f, r.Read(f))
+	for _, d := range registerTable {
+		s += fmt.Sprintf("S%02d:%03d ", d.reg, r.Read(d.reg))
 	}
 	return lineWrap(s, 80)
 }
 
+// Stored profile form
 func (r *Registers) JsonMap() map[string]byte {
 	s := make(map[string]byte)
-	for _, f := range r.activeRegisters() {
-		k := strconv.Itoa(f)
-		s[k] = r.Read(f)
+	for _, d := range registerTable {
+		k := strconv.Itoa(d.reg)
+		s[k] = r.Read(d.reg)
 	}
 	return s
 }
 
+// Registers from a stored profile.  Any the profile doesn't have keep
+// their defaults.
 func registersJsonUnmap(m map[string]byte) *Registers {
 
 	nr := NewRegisters()
+	nr.Reset()
 	for key, val := range m {
 		i, err := strconv.Atoi(key)
 		if err != nil {
 			logger.Printf("Atoi(): %s", err)
 			continue
 		}
-		if i < 0 || i > 255 {
+		d := registerDef(i)
+		switch {
+		case d == nil:
 			logger.Printf("Bad register in config: regnum = %d", i)
-		} else {
+		case d.readOnly:
+		case !d.accepts(int(val)):
+			logger.Printf("Bad value in config: S%d = %d", i, val)
+		default:
 			nr.Write(i, val)
 		}
 	}
 	return nr
 }
+
+// AT*help=S[n]
+func registerHelp(regnum int) {
+	show := func(d *regDef) {
+		ro := ""
+		if d.readOnly {
+			ro = ", read only"
+		}
+		serial.Printf("S%-3d %-26s %3d %s\n", d.reg, d.name,
+			registers.Read(d.reg), d.units)
+		serial.Printf("     %s (%d-%d, default %d%s)\n", d.help, d.min,
+			d.max, d.def, ro)
+	}
+
+	if regnum != -1 {
+		show(registerDefs[regnum])
+		return
+	}
+	for i := range registerTable {
+		show(&registerTable[i])
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+// The "replay" protocol answers a call with a recorded session (see
+// recorder.go).  The entry's Host is the asciicast or ttyrec file; what
+// the remote sent is played back to the DTE with its original timing,
+// scaled by the entry's Speed.  What the DTE sends is thrown away, or,
+// if the entry has CheckInput set and the recording is an asciicast file
+// with input events, compared against what was typed when it was made.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type replayFrame struct {
+	at   time.Duration // Since the start of the recording
+	data []byte
+}
+
+// Implements connection for replaying a recording
+type replayConn struct {
+	file       string
+	mode       bool
+	frames     []replayFrame // What the remote sent
+	expect     []byte        // What the DTE sent, if checking
+	speed      float64
+	check      bool
+	sent       uint64
+	recv       uint64
+	start      time.Time
+	next       int    // Next frame to play
+	pending    []byte // What's left of the frame being played
+	checked    int    // How much of expect the DTE has sent
+	mismatches int
+	lock       sync.Mutex
+	deadline   time.Time
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// Read an asciicast v2 file: a JSON header line then one
+// [time, type, data] event per line.
+func loadAsciicast(b []byte) ([]replayFrame, []byte, error) {
+	var frames []replayFrame
+	var input []byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("empty asciicast file")
+	}
+	var h asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return nil, nil, fmt.Errorf("bad asciicast header: %s", err)
+	}
+	if h.Version != 2 {
+		return nil, nil, fmt.Errorf("unsupported asciicast version %d",
+			h.Version)
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var ev []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if len(ev) != 3 {
+			return nil, nil, fmt.Errorf("line %d: bad event", line)
+		}
+		t, ok1 := ev[0].(float64)
+		kind, ok2 := ev[1].(string)
+		data, ok3 := ev[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, nil, fmt.Errorf("line %d: bad event", line)
+		}
+
+		switch kind {
+		case "o":
+			frames = append(frames, replayFrame{
+				time.Duration(t * float64(time.Second)),
+				[]byte(data)})
+		case "i":
+			input = append(input, data...)
+		}
+	}
+	return frames, input, scanner.Err()
+}
+
+// Read a ttyrec file: frames of seconds, microseconds and length as
+// little endian 32 bit integers, then the data.
+func loadTtyrec(b []byte) ([]replayFrame, error) {
+	var frames []replayFrame
+	var first time.Time
+
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated ttyrec frame header")
+		}
+		sec := binary.LittleEndian.Uint32(b[0:])
+		usec := binary.LittleEndian.Uint32(b[4:])
+		n := binary.LittleEndian.Uint32(b[8:])
+		b = b[12:]
+		if uint32(len(b)) < n {
+			return nil, fmt.Errorf("truncated ttyrec frame")
+		}
+
+		t := time.Unix(int64(sec), int64(usec)*1000)
+		if first.IsZero() {
+			first = t
+		}
+		frames = append(frames, replayFrame{t.Sub(first), b[:n]})
+		b = b[n:]
+	}
+	return frames, nil
+}
+
+func dialReplay(entry pb_host, log *log.Logger) (connection, error) {
+	log.Printf("Replaying: %s", entry.Host)
+	b, err := ioutil.ReadFile(entry.Host)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return nil, err
+	}
+
+	r := &replayConn{
+		file:   entry.Host,
+		mode:   DATAMODE,
+		speed:  entry.Speed,
+		check:  entry.CheckInput,
+		closed: make(chan struct{}),
+	}
+	if r.speed <= 0 {
+		r.speed = 1
+	}
+
+	// asciicast files start with their JSON header
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		r.frames, r.expect, err = loadAsciicast(b)
+	} else {
+		r.frames, err = loadTtyrec(b)
+	}
+	if err != nil {
+		err = fmt.Errorf("Can't replay %s: %s", entry.Host, err)
+		log.Print(err)
+		return nil, err
+	}
+	if r.check && len(r.expect) == 0 {
+		log.Printf("%s has no recorded input to check against",
+			entry.Host)
+		r.check = false
+	}
+
+	log.Printf("Replaying %d frames at %gx", len(r.frames), r.speed)
+	return r, nil
+}
+
+// Wait until it's time to play a frame, the read deadline passes or the
+// call is hung up.
+func (r *replayConn) waitUntil(due time.Time) error {
+	var timeout <-chan time.Time
+
+	r.lock.Lock()
+	deadline := r.deadline
+	r.lock.Unlock()
+
+	if !deadline.IsZero() && deadline.Before(due) {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	t := time.NewTimer(time.Until(due))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-timeout:
+		return timeoutError("replay: i/o timeout")
+	case <-r.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	// The clock starts when the DTE starts listening, not when the
+	// call was dialed.
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+
+	for len(r.pending) == 0 {
+		if r.next >= len(r.frames) {
+			return 0, io.EOF
+		}
+		f := r.frames[r.next]
+		due := r.start.Add(time.Duration(float64(f.at) / r.speed))
+		if err := r.waitUntil(due); err != nil {
+			return 0, err
+		}
+		r.pending = f.data
+		r.next++
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.recv += uint64(n)
+	return n, nil
+}
+
+func (r *replayConn) Write(p []byte) (int, error) {
+	r.sent += uint64(len(p))
+	if !r.check {
+		return len(p), nil
+	}
+
+	for _, c := range p {
+		switch {
+		case r.checked >= len(r.expect):
+			logger.Printf("Replay: unexpected input %q", c)
+			r.mismatches++
+		case r.expect[r.checked] != c:
+			logger.Printf("Replay: input byte %d is %q, recording has %q",
+				r.checked, c, r.expect[r.checked])
+			r.mismatches++
+		}
+		r.checked++
+	}
+	return len(p), nil
+}
+
+func (r *replayConn) Close() error {
+	r.closeOnce.Do(func() {
+		logger.Printf("Closing replay of %s", r.file)
+		if r.check {
+			logger.Printf("Replay: %d of %d input bytes sent, %d mismatched",
+				r.checked, len(r.expect), r.mismatches)
+		}
+		close(r.closed)
+	})
+	return nil
+}
+
+func (r *replayConn) RemoteAddr() net.Addr {
+	return pseudoAddr{"replay", r.file}
+}
+
+func (r *replayConn) Direction() int {
+	return OUTBOUND
+}
+
+func (r *replayConn) Mode() bool {
+	return r.mode
+}
+
+func (r *replayConn) SetMode(mode bool) {
+	r.mode = mode
+}
+
+func (r *replayConn) Stats() (uint64, uint64) {
+	return r.sent, r.recv
+}
+
+func (r *replayConn) String() string {
+	return ">replay:" + filepath.Base(r.file)
+}
+
+func (r *replayConn) DebugInfo() string {
+	s := fmt.Sprintf("Replay of %s at %gx, frame %d of %d",
+		r.file, r.speed, r.next, len(r.frames))
+	if r.check {
+		s += fmt.Sprintf(", %d input mismatches", r.mismatches)
+	}
+	return s
+}
+
+func (r *replayConn) SetDeadline(t time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.deadline = t
+	return nil
+}
@@ -36,8 +36,26 @@ var (
 	CONNECT_38400  error = NewMerror(28, "CONNECT 38400")
 	CONNECT_300    error = NewMerror(40, "CONNECT 300")
 	CONNECT_115200 error = NewMerror(87, "CONNECT 115200")
+
+	// Negotiation progress (ATW1, ATW2)
+	PROTOCOL_NONE      error = NewMerror(70, "PROTOCOL: NONE")
+	PROTOCOL_LAPM      error = NewMerror(77, "PROTOCOL: LAP-M")
+	PROTOCOL_ALT       error = NewMerror(80, "PROTOCOL: ALT") // MNP
+	COMPRESSION_NONE   error = NewMerror(69, "COMPRESSION: NONE")
+	COMPRESSION_CLASS5 error = NewMerror(66, "COMPRESSION: CLASS 5")
+	COMPRESSION_V42BIS error = NewMerror(67, "COMPRESSION: V.42BIS")
 )
 
+// CARRIER progress messages' codes, by line speed
+var carrierCodes = []struct {
+	speed int
+	code  byte
+}{
+	{300, 40}, {1200, 46}, {2400, 47}, {4800, 48}, {7200, 49},
+	{9600, 50}, {12000, 51}, {14400, 52}, {16800, 53}, {19200, 54},
+	{21600, 55}, {24000, 56}, {26400, 57}, {28800, 58},
+}
+
 func NewMerror(c byte, s string) error {
 	return &MError{c, s}
 }
@@ -73,50 +91,90 @@ func speedToResult(speed int) error {
 	}
 }
 
-func (e *MError) Error() string {
-
-	if conf.quiet {
-		logger.Printf("Quiet mode, status: %s", e)
-		return ""
+// CARRIER n, with the code of the fastest carrier no faster than speed
+func carrierResult(speed int) *MError {
+	code := carrierCodes[0].code
+	for _, c := range carrierCodes {
+		if c.speed <= speed {
+			code = c.code
+		}
 	}
+	return &MError{code, fmt.Sprintf("CARRIER %d", speed)}
+}
 
-	if e == CONNECT && conf.connectMsgSpeed {
-		me := speedToResult(m.getConnectSpeed())
-		if me != CONNECT {
-			return me.Error()
-		}
+// The protocol and compression progress messages, and CONNECT suffix, for
+// the AT&Q error control mode
+func errorControlResults() (error, error, string) {
+	switch conf.errorControl {
+	case 5:
+		return PROTOCOL_LAPM, COMPRESSION_NONE, "/ARQ"
+	case 8:
+		return PROTOCOL_ALT, COMPRESSION_CLASS5, "/ARQ"
+	case 9:
+		return PROTOCOL_LAPM, COMPRESSION_V42BIS, "/V42BIS"
 	}
+	return PROTOCOL_NONE, COMPRESSION_NONE, ""
+}
 
-	if e == BUSY && !conf.busyDetect {
-		e = nil
+// What result e is at the ATX level: X0 has only OK, CONNECT, RING, NO
+// CARRIER and ERROR, X1 adds connect speeds and NO ANSWER, X2 adds NO
+// DIALTONE to X1, X3 adds BUSY to X1 and X4 has them all.  What the
+// level doesn't have is reported as CONNECT or NO CARRIER.
+func atLevel(e *MError) *MError {
+	x := conf.resultLevel
+	switch {
+	case e == CONNECT && x > 0:
+		return speedToResult(m.getConnectSpeed()).(*MError)
+	case strings.HasPrefix(e.text, "CONNECT") && x == 0:
+		return CONNECT.(*MError)
+	case e == NO_ANSWER && x < 1,
+		e == NO_DIALTONE && x != 2 && x != 4,
+		e == BUSY && x < 3:
+		return NO_CARRIER.(*MError)
 	}
+	return e
+}
+
+func (e *MError) Error() string {
 
-	if (e == NO_DIALTONE || e == NO_ANSWER) && !conf.extendedResultCodes {
-		e = nil
+	if conf.quiet {
+		logger.Printf("Quiet mode, status: %s", e.text)
+		return ""
 	}
 
-	var s string
-	switch conf.verbose {
-	case true:
-		if e != nil {
-			s = fmt.Sprintf("%s", e.text)
-		} else {
-			s = "OK"
-		}
-	case false:
-		if e != nil {
-			s = fmt.Sprintf("%d", e.code)
-		} else {
-			s = "0"
-		}
+	e = atLevel(e)
+	s := resultText(e)
+	if _, _, suffix := errorControlResults(); conf.verbose &&
+		conf.resultLevel > 0 && strings.HasPrefix(e.text, "CONNECT") {
+		s += suffix
 	}
-	
+
 	logentry := fmt.Sprintf("Result Code: %s", s)
         logger.Print(strings.Replace(logentry, "\n", "", -1))
 
 	return s
 }
 
+// The result, as words or a number, in the personality's terms
+func resultText(e *MError) string {
+	code, text := pers.result(e)
+	if conf.verbose {
+		return text
+	}
+	return fmt.Sprintf("%d", code)
+}
+
+// ATW1, ATW2: how the connection was negotiated, before CONNECT.  The
+// speed CONNECT reports is the same either way.
+func showProgress() {
+	protocol, compression, _ := errorControlResults()
+	for _, e := range []error{carrierResult(m.getConnectSpeed()),
+		protocol, compression} {
+		serial.Println()
+		serial.Println(e)
+	}
+}
+
 // This is needed because nil errors are "OK", but Prinln(OK) can't
 // work, because 'fmt.Println((nil).Error())' is impossible.  I'm
 // starting to think overloading error as result codes is a massive
@@ -124,11 +182,10 @@ func (e *MError) Error() string {
 func prstatus(e error) {
 	time.Sleep(300 * time.Millisecond) // Cosmetic pause...
 
-	serial.Println()
 	if e == nil {
-		switch conf.verbose {
-		case true:  serial.Println("OK")
-		case false: serial.Println("0")
+		if !conf.quiet {
+			serial.Println()
+			serial.Println(resultText(nil))
 		}
 		lcd.Printf(1, "READY")
 	} else {
@@ -139,10 +196,16 @@ func prstatus(e error) {
 			logger.Printf("Error not MError: %s", e.Error())
 			e = ERROR
 		}
-		serial.Println(e)
+		if !conf.quiet {
+			if e == CONNECT && conf.negotiation > 0 {
+				showProgress()
+			}
+			serial.Println()
+			serial.Println(e)
+		}
 		switch {
 		case e == CONNECT:
-			lcd.Printf(2, "%s", m.conn)
+			lcd.Printf(2, "%s", describeConnection())
 		case e == OK:
 			lcd.Clear()
 		}
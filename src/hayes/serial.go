@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	tarmserial "github.com/tarm/serial"
+	"io"
 	"log"
 	"strings"
+	"sync"
+	"time"
 )
 
 /*
@@ -30,11 +33,39 @@ char getch(){
 */
 import "C"
 
+// Flow control (AT+IFC)
+const (
+	FLOW_NONE = iota
+	FLOW_XONXOFF
+	FLOW_RTSCTS
+)
+
+const (
+	__XON  = 0x11
+	__XOFF = 0x13
+
+	// How often a blocked Read() looks for a reconfigured port
+	__SERIAL_DTE_POLL = 100 * time.Millisecond
+
+	// How long the DTE can hold off output before we give up waiting
+	__FLOW_WAIT = time.Minute
+
+	// How long the DTE's input can wait on us before it's throttled
+	__FLOW_THROTTLE = 50 * time.Millisecond
+)
+
 type serialPort struct {
 	console bool
 	port    *tarmserial.Port
 	log     *log.Logger
 	channel chan byte
+
+	lock     sync.Mutex
+	config   tarmserial.Config  // Speed and framing now
+	pending  *tarmserial.Config // Set by AT+IPR/+ICF, used after the result
+	dceByDTE int                // How the DTE stops our output
+	dteByDCE int                // How we stop the DTE's
+	paused   bool               // The DTE sent XOFF
 }
 
 func setupSerialPort(port string, speed int) *serialPort {
@@ -42,14 +73,16 @@ func setupSerialPort(port string, speed int) *serialPort {
 
 	s.console = port == ""
 	s.channel = make(chan byte)
+	s.config = tarmserial.Config{Name: port, Baud: speed, Size: 8,
+		Parity: tarmserial.ParityNone, StopBits: tarmserial.Stop1,
+		ReadTimeout: __SERIAL_DTE_POLL}
 
 	if s.console {
 		logger.Print("Using stdin/stdout as DTE")
 	} else {
 
 		logger.Printf("Using serial port %s at %d bps", port, speed)
-		c := &tarmserial.Config{Name: port, Baud: speed}
-		p, err := tarmserial.OpenPort(c)
+		p, err := tarmserial.OpenPort(&s.config)
 		if err != nil {
 			logger.Fatal(err)
 		}
@@ -77,10 +110,30 @@ func (s *serialPort) Read(p []byte) (int, error) {
 		case '\n':
 			p[0] = registers.Read(REG_CR_CH)
 		}
+		countSerial(1, 0)
 		return 1, nil
 	}
 
-	return s.port.Read(p)
+	// The port has a read timeout so this notices when AT+IPR or
+	// AT+ICF swap it for a new one.
+	for {
+		port := s.getPort()
+		i, err := port.Read(p)
+		if i == 0 && (err == nil || err == io.EOF) {
+			continue
+		}
+		if err != nil && s.getPort() != port {
+			continue
+		}
+		countSerial(i, 0)
+		return i, err
+	}
+}
+
+func (s *serialPort) getPort() *tarmserial.Port {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.port
 }
 
 func (s *serialPort) getChars() {
@@ -91,11 +144,151 @@ func (s *serialPort) getChars() {
 			logger.Print("Read(): ", err)
 		}
 
-		s.channel <- in[0]
+		if s.flowControl(in[0]) {
+			continue
+		}
+
+		s.lock.Lock()
+		throttle := s.dteByDCE != FLOW_NONE
+		s.lock.Unlock()
+		if !throttle {
+			s.channel <- in[0]
+			continue
+		}
+
+		// Hold the DTE off if we're busy
+		select {
+		case s.channel <- in[0]:
+		case <-time.After(__FLOW_THROTTLE):
+			s.throttle(true)
+			s.channel <- in[0]
+			s.throttle(false)
+		}
 	}
 }
 
+// An XON or XOFF from the DTE, if it's using them; returns true if c
+// was one.
+func (s *serialPort) flowControl(c byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dceByDTE != FLOW_XONXOFF || (c != __XON && c != __XOFF) {
+		return false
+	}
+	s.paused = c == __XOFF
+	return true
+}
+
+// Stop or restart the DTE sending to us
+func (s *serialPort) throttle(stop bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch s.dteByDCE {
+	case FLOW_XONXOFF:
+		c := []byte{__XON}
+		if stop {
+			c[0] = __XOFF
+		}
+		if !s.console {
+			s.port.Write(c)
+		}
+	case FLOW_RTSCTS:
+		if stop {
+			lowerCTS()
+		} else {
+			raiseCTS()
+		}
+	}
+}
+
+// Wait for the DTE to let us send
+func (s *serialPort) waitToSend() {
+	deadline := time.Now().Add(__FLOW_WAIT)
+	for time.Now().Before(deadline) {
+		s.lock.Lock()
+		flow, paused := s.dceByDTE, s.paused
+		s.lock.Unlock()
+		if !(flow == FLOW_XONXOFF && paused) &&
+			!(flow == FLOW_RTSCTS && !readRTS()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logger.Print("DTE never resumed output, sending anyway")
+	s.lock.Lock()
+	s.paused = false
+	s.lock.Unlock()
+}
+
+// AT+IFC
+func (s *serialPort) SetFlowControl(dceByDTE, dteByDCE int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	logger.Printf("Flow control: %d by DTE, %d by DCE", dceByDTE, dteByDCE)
+	s.dceByDTE, s.dteByDCE = dceByDTE, dteByDCE
+	s.paused = false
+}
+
+func (s *serialPort) FlowControl() (dceByDTE, dteByDCE int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dceByDTE, s.dteByDCE
+}
+
+// The speed and framing in use, or about to be
+func (s *serialPort) Config() tarmserial.Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending != nil {
+		return *s.pending
+	}
+	return s.config
+}
+
+// AT+IPR and AT+ICF: the new settings take effect after the result code
+// has gone out at the old ones, see Reconfigure().
+func (s *serialPort) SetConfig(c tarmserial.Config) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = &c
+}
+
+// Reopen the port with any pending speed and framing
+func (s *serialPort) Reconfigure() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending == nil {
+		return
+	}
+	c := *s.pending
+	s.pending = nil
+	logger.Printf("DTE port now %d bps, %d%c%d", c.Baud, c.Size, c.Parity,
+		c.StopBits)
+	if s.console {
+		s.config = c
+		return
+	}
+
+	// Let the result code drain at the old speed first
+	time.Sleep(100*time.Millisecond +
+		time.Duration(16*10)*time.Second/time.Duration(s.config.Baud))
+
+	p, err := tarmserial.OpenPort(&c)
+	if err != nil {
+		logger.Print("Can't reconfigure DTE port: ", err)
+		return
+	}
+	s.port.Close()
+	s.port = p
+	s.config = c
+}
+
 func (s *serialPort) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.waitToSend()
 	if s.console {
 		// If we're writing to stdout, some static key mapping
 		// is needed
@@ -118,10 +311,16 @@ func (s *serialPort) Write(p []byte) (int, error) {
 		}
 
 		// This should be the only fmt.Print* in the codebase
-		return fmt.Printf("%s", str)
+		i, err := fmt.Printf("%s", str)
+		countSerial(0, i)
+		return i, err
 	}
 
-	return s.port.Write(p)
+	s.lock.Lock()
+	i, err := s.port.Write(p)
+	s.lock.Unlock()
+	countSerial(0, i)
+	return i, err
 }
 
 func (s *serialPort) WriteByte(p byte) (error) {
@@ -0,0 +1,145 @@
+package main
+
+// The "serial" protocol connects a call to another local serial port,
+// like a null-modem patch panel.  The entry's Host is the device and Baud
+// its speed.  Any tty will do, so a pty pair is enough to try it out.
+
+import (
+	"code.cloudfoundry.org/bytefmt"
+	"fmt"
+	tarmserial "github.com/tarm/serial"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Speed to open the device at if the entry doesn't give one
+const __SERIAL_DIAL_SPEED = 9600
+
+// How often a blocked Read() wakes up to check for hangups and deadlines
+const __SERIAL_POLL = 100 * time.Millisecond
+
+// Implements connection for a local serial port
+type serialConn struct {
+	device   string
+	baud     int
+	mode     bool
+	port     *tarmserial.Port
+	sent     uint64
+	recv     uint64
+	lock     sync.Mutex
+	deadline time.Time
+	closed   bool
+}
+
+func dialSerial(entry pb_host, log *log.Logger) (connection, error) {
+	baud := entry.Baud
+	if baud == 0 {
+		baud = __SERIAL_DIAL_SPEED
+	}
+	if entry.Host == flags.serialPort {
+		return nil, fmt.Errorf("Can't dial the DTE's own serial port %s",
+			entry.Host)
+	}
+
+	log.Printf("Opening %s at %d bps", entry.Host, baud)
+	c := &tarmserial.Config{Name: entry.Host, Baud: baud,
+		ReadTimeout: __SERIAL_POLL}
+	p, err := tarmserial.OpenPort(c)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return nil, err
+	}
+
+	return &serialConn{device: entry.Host, baud: baud, mode: DATAMODE,
+		port: p}, nil
+}
+
+// The port is opened with a read timeout, so a Read() with nothing to
+// read comes back empty every __SERIAL_POLL.  Keep trying until there's
+// data, the call's hung up or the deadline passes.
+func (s *serialConn) Read(p []byte) (int, error) {
+	for {
+		i, err := s.port.Read(p)
+		if i > 0 {
+			s.recv += uint64(i)
+			return i, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		s.lock.Lock()
+		closed, deadline := s.closed, s.deadline
+		s.lock.Unlock()
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, timeoutError("serial: i/o timeout")
+		}
+	}
+}
+
+func (s *serialConn) Write(p []byte) (int, error) {
+	i, err := s.port.Write(p)
+	if err != nil {
+		logger.Print(err)
+	}
+	s.sent += uint64(i)
+	return i, err
+}
+
+func (s *serialConn) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	logger.Printf("Closing serial connection to %s", s.device)
+	// Let a blocked Read() notice before the port goes away
+	time.Sleep(__SERIAL_POLL)
+	return s.port.Close()
+}
+
+func (s *serialConn) RemoteAddr() net.Addr {
+	return pseudoAddr{"serial", s.device}
+}
+
+func (s *serialConn) Direction() int {
+	return OUTBOUND
+}
+
+func (s *serialConn) Mode() bool {
+	return s.mode
+}
+
+func (s *serialConn) SetMode(mode bool) {
+	s.mode = mode
+}
+
+func (s *serialConn) Stats() (uint64, uint64) {
+	return s.sent, s.recv
+}
+
+func (s *serialConn) String() string {
+	return ">serial:" + s.device
+}
+
+func (s *serialConn) DebugInfo() string {
+	sent, recv := s.Stats()
+	return fmt.Sprintf("Serial port %s at %d bps, sent %s, received %s",
+		s.device, s.baud, bytefmt.ByteSize(sent), bytefmt.ByteSize(recv))
+}
+
+func (s *serialConn) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deadline = t
+	return nil
+}
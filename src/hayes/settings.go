@@ -0,0 +1,152 @@
+package main
+
+// Daemon settings from a config file and the environment.  The -config
+// file is a JSON object whose keys are the command line flags' names (see
+// docs/hayes.json), plus "pins", a map of pin names (HS_LED, CTS_PIN...)
+// to Raspberry Pi GPIO numbers.  HAYES_<FLAG> environment variables (with
+// "-" as "_") override the file, HAYES_PIN_<NAME> a pin, and flags given
+// on the command line override both.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const __ENV_PREFIX = "HAYES_"
+
+// Not settings themselves
+var settingsSkip = map[string]bool{"config": true, "print-config": true}
+
+// Secrets -print-config doesn't show
+var settingsSecret = map[string]bool{"apitoken": true}
+
+func envName(flagName string) string {
+	return __ENV_PREFIX +
+		strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func settingsError(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(2)
+}
+
+// Apply the config file and environment to the flags not given on the
+// command line.  Must be called after flag.Parse().
+func loadSettings() {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	set := func(name, val, from string) {
+		f := flag.Lookup(name)
+		if f == nil || settingsSkip[name] {
+			settingsError("%s: unknown setting '%s'", from, name)
+		}
+		if given[name] {
+			return
+		}
+		if err := f.Value.Set(val); err != nil {
+			settingsError("%s: bad %s '%s': %s", from, name, val, err)
+		}
+	}
+
+	flags.pins = make(map[string]int)
+	if v, ok := os.LookupEnv(envName("config")); ok && !given["config"] {
+		flags.configFile = v
+	}
+	if flags.configFile != "" {
+		var file map[string]json.RawMessage
+		b, err := ioutil.ReadFile(flags.configFile)
+		if err == nil {
+			err = json.Unmarshal(b, &file)
+		}
+		if err != nil {
+			settingsError("Can't read config file %s: %s",
+				flags.configFile, err)
+		}
+		for name, raw := range file {
+			if name == "pins" {
+				if err := json.Unmarshal(raw, &flags.pins); err != nil {
+					settingsError("%s: bad pins: %s",
+						flags.configFile, err)
+				}
+				continue
+			}
+			// Strings are quoted, numbers and bools aren't
+			var val string
+			if json.Unmarshal(raw, &val) != nil {
+				val = string(raw)
+			}
+			set(name, val, flags.configFile)
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok &&
+			!settingsSkip[f.Name] {
+			set(f.Name, v, envName(f.Name))
+		}
+	})
+	for _, e := range os.Environ() {
+		prefix := __ENV_PREFIX + "PIN_"
+		kv := strings.SplitN(e, "=", 2)
+		if !strings.HasPrefix(kv[0], prefix) || len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			settingsError("%s: bad GPIO '%s'", kv[0], kv[1])
+		}
+		flags.pins[strings.TrimPrefix(kv[0], prefix)] = n
+	}
+}
+
+// -print-config: the settings in effect, as a config file
+func printSettings() {
+	s := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if settingsSkip[f.Name] {
+			return
+		}
+		val := f.Value.String()
+		if settingsSecret[f.Name] && val != "" {
+			s[f.Name] = "********"
+			return
+		}
+		if g, ok := f.Value.(flag.Getter); ok {
+			switch v := g.Get().(type) {
+			case bool, int, int64, uint:
+				s[f.Name] = v
+				return
+			}
+		}
+		s[f.Name] = val
+	})
+	if len(flags.pins) > 0 {
+		s["pins"] = flags.pins
+	}
+
+	// encoding/json sorts the keys
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		settingsError("%s", err)
+	}
+	fmt.Println(string(b))
+}
+
+// Pin names in the config file that aren't in names
+func unknownPins(names map[string]int) []string {
+	var unknown []string
+	for name := range flags.pins {
+		if _, ok := names[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -180,6 +181,7 @@ func acceptSSH(channel chan connection, private_key string, busy busyFunc,
 			}
 
 			if busy() {
+				countBusy("ssh")
 				conn.Write([]byte("Busy...\n\r"))
 				conn.Close()
 				continue
@@ -194,6 +196,7 @@ func acceptSSH(channel chan connection, private_key string, busy busyFunc,
 // Implements connection, used to convert SSH ssh.Session for outbound SSH
 type sshDialReadWriteCloser struct {
 	mode       bool
+	lock       sync.Mutex // Reconnect() replaces in, out, client, session
 	in         io.Reader
 	out        io.WriteCloser
 	client     *ssh.Client
@@ -201,6 +204,8 @@ type sshDialReadWriteCloser struct {
 	remoteAddr net.Addr
 	sent       uint64
 	recv       uint64
+	username   string // For reconnecting
+	password   string
 }
 
 func (m *sshDialReadWriteCloser) String() string {
@@ -239,18 +244,31 @@ func (m *sshDialReadWriteCloser) DebugInfo() string {
 }
 
 func (m *sshDialReadWriteCloser) Read(p []byte) (int, error) {
-	i, err := m.in.Read(p)
+	m.lock.Lock()
+	in := m.in
+	m.lock.Unlock()
+	i, err := in.Read(p)
 	m.recv += uint64(i)
 	return i, err
 }
 
 func (m *sshDialReadWriteCloser) Write(p []byte) (int, error) {
-	i, err := m.out.Write(p)
+	m.lock.Lock()
+	out := m.out
+	m.lock.Unlock()
+	i, err := out.Write(p)
 	m.sent += uint64(i)
 	return i, err
 }
 
 func (m *sshDialReadWriteCloser) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.close()
+}
+
+// Must be called with m.lock held
+func (m *sshDialReadWriteCloser) close() error {
 	// Remember, in is an io.Reader so it doesn't Close()
 	err := m.out.Close()
 	m.session.Close()
@@ -282,7 +300,26 @@ func (m *sshDialReadWriteCloser) SetDeadline(t time.Time) error {
 	return nil
 }
 
+// Implements reconnector; the host starts a new shell.
+func (m *sshDialReadWriteCloser) Reconnect(timeout time.Duration) error {
+	n, err := dialSSHTimeout(m.remoteAddr.String(), logger, m.username,
+		m.password, timeout)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.close()
+	m.in, m.out, m.client, m.session = n.in, n.out, n.client, n.session
+	return nil
+}
+
 func dialSSH(remote string, log *log.Logger, username string, pw string) (*sshDialReadWriteCloser, error) {
+	return dialSSHTimeout(remote, log, username, pw, connectTimeout())
+}
+
+func dialSSHTimeout(remote string, log *log.Logger, username string, pw string,
+	timeout time.Duration) (*sshDialReadWriteCloser, error) {
 
 	if _, _, err := net.SplitHostPort(remote); err != nil {
 		remote += ":22"
@@ -296,7 +333,7 @@ func dialSSH(remote string, log *log.Logger, username string, pw string) (*sshDi
 			ssh.Password(pw),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Danger?
-		Timeout:         time.Duration(__CONNECT_TIMEOUT),
+		Timeout:         timeout,
 	}
 
 	client, err := ssh.Dial("tcp", remote, config)
@@ -324,7 +361,8 @@ func dialSSH(remote string, log *log.Logger, username string, pw string) (*sshDi
 		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
 	}
 	// Request pseudo terminal
-	if err := session.RequestPty("xterm", 40, 80, modes); err != nil {
+	cols, rows := terminalSize(m.entry)
+	if err := session.RequestPty("xterm", rows, cols, modes); err != nil {
 		log.Print("request for pseudo terminal failed: ", err)
 		return &sshDialReadWriteCloser{},
 			fmt.Errorf("request for pty failed: %s", err)
@@ -349,6 +387,8 @@ func dialSSH(remote string, log *log.Logger, username string, pw string) (*sshDi
 	log.Printf("Connected to remote host '%s', SSH Server version %s",
 		client.Conn.RemoteAddr(), client.Conn.ServerVersion())
 
-	return &sshDialReadWriteCloser{DATAMODE, recv, send, client, session,
-		client.Conn.RemoteAddr(), 0, 0}, nil
+	return &sshDialReadWriteCloser{mode: DATAMODE, in: recv, out: send,
+		client: client, session: session,
+		remoteAddr: client.Conn.RemoteAddr(), username: username,
+		password: pw}, nil
 }
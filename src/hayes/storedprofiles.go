@@ -1,9 +1,28 @@
 package main
 
+// Stored profiles: the two numbered profiles of AT&W0/1, ATZ0/1 and
+// AT&Y, plus any number of named ones (AT&W=name, ATZ=name), and the
+// AT&Z stored numbers, kept in the -profiles file.  The file is replaced
+// atomically when it changes, and one that can't be read is set aside (as
+// file.bad) for factory defaults.
+
 import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Version 1 files have no version, no named profiles and the old result
+// code booleans; version 2 files have no stored numbers.
+const __PROFILES_VERSION = 3
+
+// AT&Z0 to AT&Z3, each up to 36 characters
+const (
+	__STORED_NUMBERS    = 4
+	__MAX_STORED_NUMBER = 36
 )
 
 type configtype struct { // `json:"Config"`
@@ -15,17 +34,26 @@ type configtype struct { // `json:"Config"`
 	SpeakerVolume       int  `json:"SpeakerVolume"`
 	Verbose             bool `json:"Verbose"`
 	Quiet               bool `json:"Quiet"`
-	ConnectMsgSpeed     bool `json:"ConnectMsgSpeed"`
-	BusyDetect          bool `json:"BusyDetect"`
-	ExtendedResultCodes bool `json:"ExtendedResultCodes"`
+	ResultLevel         int  `json:"ResultLevel"`  // X
+	Negotiation         int  `json:"Negotiation"`  // W
+	ErrorControl        int  `json:"ErrorControl"` // &Q
 	DCDPinned           bool `json:"DCDPinned"`
 	DSRPinned           bool `json:"DSRPinned"`
 	DTR                 int  `json:"DSR"`
+
+	// Profiles saved before ResultLevel had these instead
+	ConnectMsgSpeed     bool `json:"ConnectMsgSpeed,omitempty"`
+	BusyDetect          bool `json:"BusyDetect,omitempty"`
+	ExtendedResultCodes bool `json:"ExtendedResultCodes,omitempty"`
 }
 
 type storedProfiles struct {
-	PowerUpConfig int `json:"PowerUpConfig"`
-	Config        [2]configtype
+	Version       int                      `json:"Version"`
+	PowerUpConfig int                      `json:"PowerUpConfig"`
+	Config        [2]configtype            `json:"Config"`
+	Named         map[string]configtype    `json:"Named"`
+	Numbers       [__STORED_NUMBERS]string `json:"Numbers"` // AT&Z
+	filename      string
 }
 
 func (c *configtype) Reset() {
@@ -37,32 +65,74 @@ func (c *configtype) Reset() {
 	c.SpeakerVolume = 1
 	c.Verbose = true
 	c.Quiet = false
-	c.ConnectMsgSpeed = true
-	c.BusyDetect = true
-	c.ExtendedResultCodes = true
+	c.ResultLevel = 4
+	c.Negotiation = 0
+	c.ErrorControl = 0
 	c.DCDPinned = false
 	c.DSRPinned = false
 	c.DTR = 0
 }
 
-func newStoredProfiles() (*storedProfiles, error) {
+// Convert a profile saved with the old result code booleans.  X1 and X2
+// were both "extended", X3 and up added busy detection.
+func (c *configtype) migrate() {
+	if c.ExtendedResultCodes || c.BusyDetect {
+		c.ResultLevel = 1
+		if c.BusyDetect {
+			c.ResultLevel = 4
+		}
+		logger.Printf("Stored profile result codes now X%d", c.ResultLevel)
+	}
+	c.ConnectMsgSpeed = false
+	c.BusyDetect = false
+	c.ExtendedResultCodes = false
+}
+
+func newStoredProfiles(filename string) (*storedProfiles, error) {
 	var c storedProfiles
 
-	b, err := ioutil.ReadFile("hayes.config.json")
-	if err != nil {
+	defaults := func() {
+		c = storedProfiles{filename: filename}
+		c.Version = __PROFILES_VERSION
 		c.PowerUpConfig = -1
 		c.Config[0].Reset()
 		c.Config[1].Reset()
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		defaults()
 		e := fmt.Errorf("Can't read config file: %s", err)
 		logger.Print(e)
 		return &c, e
 	}
 
-	if err = json.Unmarshal(b, &c); err != nil {
-		logger.Printf("Can't load stored configs: %s", err)
+	err = json.Unmarshal(b, &c)
+	if err == nil && c.Version > __PROFILES_VERSION {
+		err = fmt.Errorf("version %d is newer than %d", c.Version,
+			__PROFILES_VERSION)
+	}
+	if err != nil {
+		logger.Printf("Can't load stored configs from %s: %s", filename, err)
+		if e := os.Rename(filename, filename+".bad"); e == nil {
+			logger.Printf("Moved %s to %s.bad", filename, filename)
+		}
+		defaults()
 		return &c, err
 	}
+	c.filename = filename
 
+	if c.Version < 2 {
+		for i := range c.Config {
+			c.Config[i].migrate()
+		}
+	}
+	for name, p := range c.Named {
+		if p.Regs == nil {
+			delete(c.Named, name)
+		}
+	}
+	c.Version = __PROFILES_VERSION
 	logger.Print("Loaded stored profiles")
 
 	return &c, nil
@@ -74,7 +144,7 @@ func (s *storedProfiles) Write() error {
 		logger.Print(err)
 		return err
 	}
-	err = ioutil.WriteFile("hayes.config.json", b, 0644)
+	err = writeFileAtomic(s.filename, b, 0644)
 	if err != nil {
 		logger.Print(err)
 	}
@@ -82,24 +152,6 @@ func (s *storedProfiles) Write() error {
 }
 
 func (s *storedProfiles) String() string {
-	b := func(p bool) string {
-		if p {
-			return "1 "
-		}
-		return "0 "
-	}
-	i := func(p int) string {
-		return fmt.Sprintf("%d ", p)
-	}
-	x := func(r, b bool) string {
-		if r == true && b == false {
-			return "1 "
-		}
-		if r == true && b == true {
-			return "7 "
-		}
-		return "0 "
-	}
 	r := func(r map[string]byte) string {
 		reg := registersJsonUnmap(r)
 		return reg.String()
@@ -107,39 +159,24 @@ func (s *storedProfiles) String() string {
 
 	var str string
 	for p := 0; p < 2; p++ {
-		t := "B16 B1 B41 B60 "
-		t += "E" + b(s.Config[p].EchoInCmdMode)
-		t += "F1 " // For Hayes 1200 compatability
-		t += "L" + i(s.Config[p].SpeakerVolume)
-		t += "M" + i(s.Config[p].SpeakerMode)
-		t += "N1 "
-		t += "Q" + b(s.Config[p].Quiet)
-		t += "V" + b(s.Config[p].Verbose)
-		t += "W" + b(s.Config[p].ConnectMsgSpeed)
-		t += "X" +
-			x(s.Config[p].ExtendedResultCodes, s.Config[p].BusyDetect)
-		t += "Y0 "
-		t += "&A0 "
-		t += "&C" + b(s.Config[p].DCDPinned)
-		t += "&D" + i(s.Config[p].DTR)
-		t += "&G0 "
-		t += "&J0 "
-		t += "&K0 "
-		t += "&Q5 "
-		t += "&R0 "
-		t += "&S" + b(s.Config[p].DSRPinned)
-		t += "&T4 "
-		t += "&U0 "
-		t += "&X4 "
-
-		str += fmt.Sprintf("STORED PROFILE %d:\n", p) + lineWrap(t, 80) +
-			"\n"
+		str += fmt.Sprintf("STORED PROFILE %d:\n", p) +
+			pers.profileLine(s.Config[p]) + "\n"
 		str += r(s.Config[p].Regs)
 		str += "\n"
 		if p == 0 {
 			str += "\n"
 		}
 	}
+
+	if len(s.Named) > 0 {
+		var names []string
+		for name := range s.Named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		str += "\nNAMED PROFILES:\n" + lineWrap(strings.Join(names, " "), 80) +
+			"\n"
+	}
 	return str
 }
 
@@ -149,22 +186,46 @@ func (s storedProfiles) Switch(i int) error {
 	}
 
 	logger.Printf("Switching to profile %d", i)
+	m.currentConfig = i
+	s.Config[i].activate()
+	return nil
+}
+
+// ATZ=name
+func (s storedProfiles) SwitchNamed(name string) error {
+	c, ok := s.Named[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("No stored profile '%s'", name)
+	}
+
+	logger.Printf("Switching to profile '%s'", name)
+	c.activate()
+	return nil
+}
+
+// Make c the active configuration and registers
+func (c configtype) activate() {
 	conf.Reset()
-	conf.echoInCmdMode = s.Config[i].EchoInCmdMode
-	conf.speakerVolume = s.Config[i].SpeakerVolume
-	conf.speakerMode = s.Config[i].SpeakerMode
-	conf.quiet = s.Config[i].Quiet
-	conf.verbose = s.Config[i].Verbose
-	conf.connectMsgSpeed = s.Config[i].ConnectMsgSpeed
-	conf.extendedResultCodes = s.Config[i].ExtendedResultCodes
-	conf.busyDetect = s.Config[i].BusyDetect
-	conf.dcdPinned = s.Config[i].DCDPinned
-	conf.dsrPinned = s.Config[i].DSRPinned
-	conf.dtr = s.Config[i].DTR
+	conf.echoInCmdMode = c.EchoInCmdMode
+	conf.speakerVolume = c.SpeakerVolume
+	conf.speakerMode = c.SpeakerMode
+	conf.quiet = c.Quiet
+	conf.verbose = c.Verbose
+	conf.resultLevel = c.ResultLevel
+	conf.negotiation = c.Negotiation
+	conf.errorControl = c.ErrorControl
+	conf.dcdPinned = c.DCDPinned
+	conf.dsrPinned = c.DSRPinned
+	conf.dtr = c.DTR
 	registers.Reset()
-	registers = registersJsonUnmap(s.Config[i].Regs)
+	registers = registersJsonUnmap(c.Regs)
+}
 
-	return nil
+// The active configuration and registers, in stored profile form
+func activeConfig() configtype {
+	c := conf.stored()
+	c.Regs = registers.JsonMap()
+	return c
 }
 
 // AT&Wn
@@ -173,22 +234,56 @@ func (s *storedProfiles) writeActive(i int) error {
 		return fmt.Errorf("Invalid config number %d", i)
 	}
 
-	s.Config[i].Regs = registers.JsonMap()
-	s.Config[i].EchoInCmdMode = conf.echoInCmdMode
-	s.Config[i].SpeakerVolume = conf.speakerVolume
-	s.Config[i].SpeakerMode = conf.speakerMode
-	s.Config[i].Quiet = conf.quiet
-	s.Config[i].Verbose = conf.verbose
-	s.Config[i].ConnectMsgSpeed = conf.connectMsgSpeed
-	s.Config[i].ExtendedResultCodes = conf.extendedResultCodes
-	s.Config[i].BusyDetect = conf.busyDetect
-	s.Config[i].DCDPinned = conf.dcdPinned
-	s.Config[i].DSRPinned = conf.dsrPinned
-	s.Config[i].DTR = conf.dtr
-	
+	s.Config[i] = activeConfig()
+	return s.Write()
+}
+
+// AT&W=name
+func (s *storedProfiles) writeNamed(name string) error {
+	if name == "" {
+		return fmt.Errorf("Profile name missing")
+	}
+	if s.Named == nil {
+		s.Named = make(map[string]configtype)
+	}
+	s.Named[strings.ToLower(name)] = activeConfig()
+	return s.Write()
+}
+
+// AT&Zn=number, or AT&Zn= to clear it
+func (s *storedProfiles) storeNumber(n int, number string) error {
+	if n < 0 || n >= __STORED_NUMBERS {
+		return fmt.Errorf("Invalid stored number %d", n)
+	}
+	number = strings.TrimSpace(number)
+	if len(number) > __MAX_STORED_NUMBER {
+		return fmt.Errorf("Stored number too long: %s", number)
+	}
+	if d := dialedNumber(number); number != "" && !isValidPhoneNumber(d) {
+		return fmt.Errorf("Invalid phone number '%s'", number)
+	}
+	s.Numbers[n] = number
 	return s.Write()
 }
 
+// Stored number n, or "" if there isn't one
+func (s *storedProfiles) storedNumber(n int) string {
+	if n < 0 || n >= __STORED_NUMBERS {
+		return ""
+	}
+	return s.Numbers[n]
+}
+
+// The stored numbers, as AT&V shows them
+func (s *storedProfiles) numbersString() string {
+	var str string
+	for n := 0; n < __STORED_NUMBERS; n += 2 {
+		str += fmt.Sprintf("%-40s&Z%d=%s\n",
+			fmt.Sprintf("&Z%d=%s", n, s.Numbers[n]), n+1, s.Numbers[n+1])
+	}
+	return str
+}
+
 // AT&Y
 func (s *storedProfiles) setPowerUpConfig(i int) error {
 	if i != 0 && i != 1 {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -82,11 +83,18 @@ func decode(b byte) string {
 type telnetReadWriteCloser struct {
 	direction int
 	mode      bool
+	lock      sync.Mutex // Reconnect() replaces c
 	c         net.Conn
 	sent      uint64
 	recv      uint64
 }
 
+func (m *telnetReadWriteCloser) conn() net.Conn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.c
+}
+
 func (m *telnetReadWriteCloser) DebugInfo() string {
 	var s, p, host string
 	if m.direction == INBOUND {
@@ -96,7 +104,7 @@ func (m *telnetReadWriteCloser) DebugInfo() string {
 		s = "Outbound"
 		p = "to"
 	}
-	ip, _, err := net.SplitHostPort(m.c.RemoteAddr().String())
+	ip, _, err := net.SplitHostPort(m.conn().RemoteAddr().String())
 	if err != nil {
 		logger.Printf("SplitHostPort(): %s", err)
 	}
@@ -110,7 +118,7 @@ func (m *telnetReadWriteCloser) DebugInfo() string {
 	sent, recv := m.Stats()
 
 	s = fmt.Sprintf("%s %s %s (%s), sent %s, received %s",
-		s, p, host, m.c.RemoteAddr(), 
+		s, p, host, m.conn().RemoteAddr(), 
 		bytefmt.ByteSize(sent), bytefmt.ByteSize(recv))
 
 	return s
@@ -124,7 +132,7 @@ func (m *telnetReadWriteCloser) String() string {
 		s = "<"
 	}
 
-	ip, _, err := net.SplitHostPort(m.c.RemoteAddr().String())
+	ip, _, err := net.SplitHostPort(m.conn().RemoteAddr().String())
 	if err != nil {
 		logger.Printf("SplitHostPort(): %s", err)
 	}
@@ -147,48 +155,49 @@ func (m *telnetReadWriteCloser) command(p []byte) (i int, err error) {
 	}
 
 	var s string
-	i, err = m.c.Read(p)
+	c := m.conn()
+	i, err = c.Read(p)
 	s += decode(p[0])
 
 	switch p[0] {
 	case SB:
 		// Comsume options until we read a final SE
 		for p[0] != SE {
-			i, err = m.c.Read(p)
+			i, err = c.Read(p)
 			s += decode(p[0])
 		}
-		i, err = m.c.Read(p) // read one beyond the SE
+		i, err = c.Read(p) // read one beyond the SE
 		
 	case WILL:
-		m.c.Read(p)
+		c.Read(p)
 		s += decode(p[0])
 		if p[0] != LINEMODE && p[0] != ECHO {
-			m.c.Write([]byte{IAC, DONT, p[0]})
+			c.Write([]byte{IAC, DONT, p[0]})
 		}
-		i, err = m.c.Read(p) // read next char
+		i, err = c.Read(p) // read next char
 		
 	case DO:
-		m.c.Read(p)
+		c.Read(p)
 		s += decode(p[0])
 		if p[0] != LINEMODE && p[0] != ECHO {
-			m.c.Write([]byte{IAC, WONT, p[0]})
+			c.Write([]byte{IAC, WONT, p[0]})
 		}
-		i, err = m.c.Read(p) // read next char
+		i, err = c.Read(p) // read next char
 		
 	case DONT:
-		m.c.Read(p)
+		c.Read(p)
 		s += decode(p[0])
-		m.c.Write([]byte{IAC, WONT, p[0]})
-		i, err = m.c.Read(p) // read next char
+		c.Write([]byte{IAC, WONT, p[0]})
+		i, err = c.Read(p) // read next char
 		
 	case WONT:
-		m.c.Read(p)
+		c.Read(p)
 		s += decode(p[0])
-		m.c.Write([]byte{IAC, DONT, p[0]})
-		i, err = m.c.Read(p) // read next char
+		c.Write([]byte{IAC, DONT, p[0]})
+		i, err = c.Read(p) // read next char
 		
 	case NOP, DM, BRK, IP, AO, AYT, EC, EL, GA, SE:
-		m.c.Read(p)		
+		c.Read(p)		
 
 	case IAC: // Two in a row, it's just ASCII 255
 
@@ -198,7 +207,7 @@ func (m *telnetReadWriteCloser) command(p []byte) (i int, err error) {
 }
 
 func (m *telnetReadWriteCloser) Read(p []byte) (int, error) {
-	i, err := m.c.Read(p)
+	i, err := m.conn().Read(p)
 
 	// If it's a telnet command, process it
 	for p[0] == IAC {
@@ -209,7 +218,7 @@ func (m *telnetReadWriteCloser) Read(p []byte) (int, error) {
 }
 
 func (m *telnetReadWriteCloser) Write(p []byte) (int, error) {
-	i, err := m.c.Write(p)
+	i, err := m.conn().Write(p)
 	if err != nil {
 		logger.Print(err)
 	}
@@ -219,7 +228,25 @@ func (m *telnetReadWriteCloser) Write(p []byte) (int, error) {
 
 func (m *telnetReadWriteCloser) Close() error {
 	logger.Printf("Closing telnet connection to %s", m.RemoteAddr())
-	return m.c.Close()
+	return m.conn().Close()
+}
+
+// Implements reconnector for outbound calls
+func (m *telnetReadWriteCloser) Reconnect(timeout time.Duration) error {
+	if m.direction != OUTBOUND {
+		return fmt.Errorf("can't reconnect an incoming call")
+	}
+	c, err := net.DialTimeout("tcp", m.RemoteAddr().String(), timeout)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Reconnected to %s", c.RemoteAddr())
+	m.lock.Lock()
+	old := m.c
+	m.c = c
+	m.lock.Unlock()
+	old.Close()
+	return nil
 }
 
 func (m *telnetReadWriteCloser) Mode() bool {
@@ -231,7 +258,7 @@ func (m *telnetReadWriteCloser) Direction() int {
 }
 
 func (m *telnetReadWriteCloser) RemoteAddr() net.Addr {
-	return m.c.RemoteAddr()
+	return m.conn().RemoteAddr()
 }
 
 func (m *telnetReadWriteCloser) SetMode(mode bool) {
@@ -243,7 +270,7 @@ func (m *telnetReadWriteCloser) Stats() (uint64, uint64) {
 }
 
 func (m *telnetReadWriteCloser) SetDeadline(t time.Time) error {
-	return m.c.SetDeadline(t)
+	return m.conn().SetDeadline(t)
 }
 
 func acceptTelnet(channel chan connection, busy busyFunc, log *log.Logger,
@@ -268,6 +295,7 @@ func acceptTelnet(channel chan connection, busy busyFunc, log *log.Logger,
 		}
 
 		if busy() {
+			countBusy("telnet")
 			conn.Write([]byte("Busy...\n\r"))
 			conn.Close()
 			continue
@@ -278,7 +306,8 @@ func acceptTelnet(channel chan connection, busy busyFunc, log *log.Logger,
 		conn.Write([]byte{IAC, DO, LINEMODE}) // You go into linemode
 		conn.Write([]byte{IAC, WILL, ECHO})   // I'll echo to you
 
-		channel <- &telnetReadWriteCloser{INBOUND, DATAMODE, conn, 0, 0}
+		channel <- &telnetReadWriteCloser{direction: INBOUND, mode: DATAMODE,
+			c: conn}
 	}
 }
 
@@ -288,7 +317,7 @@ func dialTelnet(remote string, log *log.Logger) (connection, error) {
 		remote += ":23"
 	}
 	log.Printf("Connecting to: %s", remote)
-	conn, err := net.DialTimeout("tcp", remote, __CONNECT_TIMEOUT)
+	conn, err := net.DialTimeout("tcp", remote, connectTimeout())
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			log.Print("net.DialTimeout: Timed out")
@@ -298,5 +327,6 @@ func dialTelnet(remote string, log *log.Logger) (connection, error) {
 	}
 
 	log.Printf("Connected to %s", conn.RemoteAddr())
-	return &telnetReadWriteCloser{OUTBOUND, DATAMODE, conn, 0, 0}, nil
+	return &telnetReadWriteCloser{direction: OUTBOUND, mode: DATAMODE,
+		c: conn}, nil
 }
@@ -0,0 +1,208 @@
+package main
+
+// Data-mode traffic between the DTE and the remote can be run through a
+// pipeline of translation stages (character sets, terminal emulation,
+// line endings...) so old machines can make sense of modern hosts.  The
+// pipeline is built when a call connects, from the S-registers and the
+// phonebook entry dialed, and rebuilt if the settings change mid call.
+
+import (
+	"sync"
+)
+
+// One step in the pipeline.  Stages may keep state between calls, so
+// they see a call's traffic in order; each direction is independent.
+type stage interface {
+	ToDTE(p []byte) []byte   // Remote -> DTE
+	FromDTE(p []byte) []byte // DTE -> remote
+}
+
+// Data to the DTE goes through the stages in order, data from the DTE in
+// reverse order.
+type pipeline []stage
+
+func (p pipeline) ToDTE(b []byte) []byte {
+	for _, s := range p {
+		b = s.ToDTE(b)
+	}
+	return b
+}
+
+func (p pipeline) FromDTE(b []byte) []byte {
+	for i := len(p) - 1; i >= 0; i-- {
+		b = p[i].FromDTE(b)
+	}
+	return b
+}
+
+// The translation settings in effect for a call.
+type lineSettings struct {
+	dteCharset  byte
+	hostCharset byte
+	terminal    byte
+	cols        int // 0 if not set
+	rows        int
+	dteEOL      byte
+	hostEOL     byte
+	pad         int
+	echo        bool
+}
+
+var translation struct {
+	lock     sync.Mutex
+	active   bool // A call is connected
+	settings lineSettings
+	pipe     pipeline
+}
+
+// The settings from the S-registers
+func registerSettings() lineSettings {
+	var s lineSettings
+	s.dteCharset = registers.Read(REG_DTE_CHARSET)
+	s.hostCharset = registers.Read(REG_HOST_CHARSET)
+	s.terminal = registers.Read(REG_TERMINAL)
+	s.cols = int(registers.Read(REG_COLUMNS))
+	s.rows = int(registers.Read(REG_ROWS))
+	s.dteEOL = registers.Read(REG_DTE_EOL)
+	s.hostEOL = registers.Read(REG_HOST_EOL)
+	s.pad = int(registers.Read(REG_CR_PAD))
+	s.echo = registers.Read(REG_LOCAL_ECHO) != 0
+	return s
+}
+
+// Override the registers with anything the phonebook entry sets
+func (s *lineSettings) applyEntry(e *pb_host) {
+	if e == nil {
+		return
+	}
+	if err := e.checkTranslation(); err != nil {
+		logger.Printf("Phonebook entry %s: %s", e.displayName(), err)
+		return
+	}
+	if cs, ok := charsetByName(e.Charset); ok {
+		s.hostCharset = cs
+	}
+	if cs, ok := charsetByName(e.DTECharset); ok {
+		s.dteCharset = cs
+	}
+	if t, ok := terminalByName(e.Terminal); ok {
+		s.terminal = t
+	}
+	if e.Columns != 0 {
+		s.cols = e.Columns
+	}
+	if e.Rows != 0 {
+		s.rows = e.Rows
+	}
+	if eol, ok := eolByName(e.DTELineEnd); ok {
+		s.dteEOL = eol
+	}
+	if eol, ok := eolByName(e.HostLineEnd); ok {
+		s.hostEOL = eol
+	}
+	if e.CRPadding != 0 {
+		s.pad = e.CRPadding
+	}
+	if e.LocalEcho {
+		s.echo = true
+	}
+}
+
+// Update the setting kept in register reg.  Returns false if reg isn't a
+// translation register.
+func (s *lineSettings) set(reg int, val byte) bool {
+	switch reg {
+	case REG_DTE_CHARSET:
+		s.dteCharset = val
+	case REG_HOST_CHARSET:
+		s.hostCharset = val
+	case REG_TERMINAL:
+		s.terminal = val
+	case REG_COLUMNS:
+		s.cols = int(val)
+	case REG_ROWS:
+		s.rows = int(val)
+	case REG_DTE_EOL:
+		s.dteEOL = val
+	case REG_HOST_EOL:
+		s.hostEOL = val
+	case REG_CR_PAD:
+		s.pad = int(val)
+	case REG_LOCAL_ECHO:
+		s.echo = val != 0
+	default:
+		return false
+	}
+	return true
+}
+
+func newPipeline(s lineSettings) pipeline {
+	var p pipeline
+	utf8 := s.hostCharset == CHARSET_NONE || s.hostCharset == CHARSET_UTF8
+	cols, rows := s.cols, s.rows
+	if cols == 0 {
+		cols = __TERM_COLS
+	}
+	if rows == 0 {
+		rows = __TERM_ROWS
+	}
+
+	if a := newAnsiStage(s.terminal, cols, rows, utf8); a != nil {
+		p = append(p, a)
+	}
+	if r := newReflowStage(s.cols, utf8); r != nil {
+		p = append(p, r)
+	}
+	if l := newLineStage(s.dteEOL, s.hostEOL, s.pad); l != nil {
+		p = append(p, l)
+	}
+	if cs := newCharsetStage(s.dteCharset, s.hostCharset); cs != nil {
+		p = append(p, cs)
+	}
+	return p
+}
+
+// A call has connected; build its pipeline.
+func startTranslation() {
+	s := registerSettings()
+	s.applyEntry(m.entry)
+
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+	translation.active = true
+	translation.settings = s
+	translation.pipe = newPipeline(s)
+	logger.Printf("Translation: %d stages", len(translation.pipe))
+}
+
+// The call is over
+func stopTranslation() {
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+	translation.active = false
+	translation.pipe = nil
+}
+
+// Register reg has changed; if it's a translation setting and there's a
+// call up, rebuild its pipeline.
+func updateTranslation(reg int, val byte) {
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+	if !translation.active || !translation.settings.set(reg, val) {
+		return
+	}
+	translation.pipe = newPipeline(translation.settings)
+	logger.Printf("Translation: now %d stages", len(translation.pipe))
+}
+
+func translateToDTE(p []byte) []byte {
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+	return translation.pipe.ToDTE(p)
+}
+
+func translateFromDTE(p []byte) []byte {
+	translation.lock.Lock()
+	defer translation.lock.Unlock()
+	return translation.pipe.FromDTE(p)
+}